@@ -4,11 +4,10 @@
 package browserchannel
 
 import (
+	"bytes"
+	"context"
 	"errors"
-	"io"
 	"log"
-	"net/http"
-	"strconv"
 )
 
 const dataChannelCapacity = 128
@@ -17,11 +16,18 @@ const dataChannelCapacity = 128
 type backChannel interface {
 	getRequestId() string
 	isReusable() bool
+	// Persistent back channels aren't recycled: they don't expire and aren't
+	// replaced to get acknowledgments since the client acknowledges the
+	// arrays on the same connection.
+	isPersistent() bool
 	setChunked(bool)
 	isChunked() bool
 	send(data []byte) error
 	discard()
-	wait()
+	// Writes the data sent on the back channel until it is discarded. Returns
+	// early when the request is cancelled or a write fails, in which case the
+	// back channel is removed from the channel.
+	wait(ctx context.Context, channel *Channel)
 }
 
 // Common bookeeping information shared between the chunked XHR and HTML
@@ -29,7 +35,7 @@ type backChannel interface {
 type backChannelBase struct {
 	sid       SessionId
 	rid       string
-	w         http.ResponseWriter
+	out       *chunkWriter
 	chunked   bool
 	bytesSent int
 	dataChan  chan []byte
@@ -44,6 +50,10 @@ func (b *backChannelBase) isReusable() bool {
 	return b.chunked && b.bytesSent < 10*1024 && b.err == nil
 }
 
+func (b *backChannelBase) isPersistent() bool {
+	return false
+}
+
 func (b *backChannelBase) setChunked(chunked bool) {
 	b.chunked = chunked
 }
@@ -67,17 +77,41 @@ func (b *backChannelBase) isChunked() bool {
 	return b.chunked
 }
 
+// Writes the data sent on the back channel, formatted by the given function,
+// until the back channel is discarded. Returns false if the request was
+// cancelled or a write failed, after removing the back channel from the
+// channel so the client is asked to open a new one and the unacknowledged
+// arrays are sent again.
+func (b *backChannelBase) run(ctx context.Context, channel *Channel, bc backChannel,
+	kind string, format func([]byte) []byte) bool {
+	for {
+		select {
+		case data, ok := <-b.dataChan:
+			if !ok {
+				return true
+			}
+			log.Printf("%s[%s] %s back channel send: %s\n", b.sid, b.rid, kind, data)
+			if err := b.out.writeChunk(format(data)); err != nil {
+				log.Printf("%s[%s] %s back channel write failed: %s\n", b.sid, b.rid, kind, err)
+				channel.failBackChannel(bc)
+				return false
+			}
+		case <-ctx.Done():
+			log.Printf("%s[%s] %s back channel request done: %s\n", b.sid, b.rid, kind, ctx.Err())
+			channel.failBackChannel(bc)
+			return false
+		}
+	}
+}
+
 // The chunked XHR back channel implementation.
 type xhrBackChannel struct {
 	backChannelBase
 }
 
-func (b *xhrBackChannel) wait() {
-	for data := range b.dataChan {
-		log.Printf("%s[%s] xhr back channel send: %s\n", b.sid, b.rid, data)
-		str := strconv.FormatInt(int64(len(data)), 10) + "\n" + string(data)
-		io.WriteString(b.w, str)
-		b.w.(http.Flusher).Flush()
+func (b *xhrBackChannel) wait(ctx context.Context, channel *Channel) {
+	if b.run(ctx, channel, b, "xhr", lengthPrefixed) {
+		b.out.close()
 	}
 
 	log.Printf("%s[%s] bind wait done\n", b.sid, b.rid)
@@ -95,28 +129,33 @@ type htmlBackChannel struct {
 	domain      string
 }
 
-func (b *htmlBackChannel) wait() {
-	for data := range b.dataChan {
-		log.Printf("%s[%s] html back channel send: %s\n", b.sid, b.rid, data)
-
-		if !b.paddingSent {
-			writeHtmlHead(b.w)
-			writeHtmlDomain(b.w, b.domain)
-		}
+func (b *htmlBackChannel) wait(ctx context.Context, channel *Channel) {
+	if b.run(ctx, channel, b, "html", b.formatChunk) {
+		var done bytes.Buffer
+		writeHtmlDone(&done)
+		b.out.writeChunk(done.Bytes())
+		b.out.close()
+	}
 
-		writeHtmlRpc(b.w, string(data))
+	log.Printf("%s[%s] bind wait done\n", b.sid, b.rid)
+}
 
-		if !b.paddingSent {
-			writeHtmlPadding(b.w)
-			b.paddingSent = true
-		}
+func (b *htmlBackChannel) formatChunk(data []byte) []byte {
+	var chunk bytes.Buffer
 
-		b.w.(http.Flusher).Flush()
+	if !b.paddingSent {
+		writeHtmlHead(&chunk)
+		writeHtmlDomain(&chunk, b.domain)
 	}
 
-	writeHtmlDone(b.w)
+	writeHtmlRpc(&chunk, string(data))
 
-	log.Printf("%s[%s] bind wait done\n", b.sid, b.rid)
+	if !b.paddingSent {
+		writeHtmlPadding(&chunk)
+		b.paddingSent = true
+	}
+
+	return chunk.Bytes()
 }
 
 func (b *htmlBackChannel) discard() {
@@ -124,12 +163,12 @@ func (b *htmlBackChannel) discard() {
 	close(b.dataChan)
 }
 
-func newBackChannel(sid SessionId, w http.ResponseWriter, html bool,
+func newBackChannel(sid SessionId, out *chunkWriter, html bool,
 	domain string, rid string) (bc backChannel) {
 	base := backChannelBase{
 		sid:      sid,
 		rid:      rid,
-		w:        w,
+		out:      out,
 		dataChan: make(chan []byte, dataChannelCapacity)}
 
 	if html {
@@ -0,0 +1,82 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A response writer whose connection is broken.
+type brokenResponseWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w *brokenResponseWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+// Runs a XHR back channel writing to rw until its wait method returns.
+func runXhrBackChannel(c *Channel, ctx context.Context, rw http.ResponseWriter) (done chan bool) {
+	out := newChunkWriter(rw, false)
+	out.start()
+	bc := newBackChannel(c.Sid, out, false, "", "1")
+	bc.setChunked(true)
+	c.setBackChannel(bc)
+
+	done = make(chan bool)
+	go func() {
+		bc.wait(ctx, c)
+		done <- true
+	}()
+	return
+}
+
+// Verifies that the back channel was cleared and the unacknowledged arrays
+// will be sent again.
+func verifyBackChannelFailed(t *testing.T, c *Channel, done chan bool) {
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected wait to return")
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.backChannel != nil {
+		t.Error("expected back channel to be cleared")
+	}
+	if c.channelTimeout == nil {
+		t.Error("expected reopen timeout to be armed")
+	}
+	if c.lastSentArrayId != 0 {
+		t.Errorf("expected last sent array id 0, got %d", c.lastSentArrayId)
+	}
+}
+
+func TestBackChannelRequestCancelled(t *testing.T) {
+	c := newChannel("8", SessionId{}, make(chan SessionId, 1), "", channelSettings{})
+	defer c.terminate(CloseClientTerminated)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := runXhrBackChannel(c, ctx, httptest.NewRecorder())
+	cancel()
+
+	verifyBackChannelFailed(t, c, done)
+}
+
+func TestBackChannelWriteFailed(t *testing.T) {
+	c := newChannel("8", SessionId{}, make(chan SessionId, 1), "", channelSettings{})
+	defer c.terminate(CloseClientTerminated)
+
+	rw := &brokenResponseWriter{httptest.NewRecorder()}
+	done := runXhrBackChannel(c, context.Background(), rw)
+
+	verifyBackChannelFailed(t, c, done)
+}
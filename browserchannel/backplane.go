@@ -0,0 +1,364 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownSession = errors.New("unknown session")
+
+	errBackplaneClosed       = errors.New("backplane closed")
+	errBackplaneDisconnected = errors.New("backplane disconnected")
+)
+
+// The delay between the attempts to reconnect to a TCP backplane server.
+const backplaneRedialDelay = 1 * time.Second
+
+// The time allowed for publishing a message on a TCP backplane. The connection
+// is reestablished when the server doesn't keep up.
+const backplaneWriteTimeout = 5 * time.Second
+
+// The number of messages buffered for each connection of a TCP backplane
+// server. Connections that can't keep up are closed.
+const backplaneConnBuffer = 1024
+
+// A message published on a backplane. Messages with a session id are sent to
+// the session while the others are sent to the channels subscribed to the
+// topic.
+type BackplaneMessage struct {
+	Sid   SessionId `json:"sid"`
+	Topic string    `json:"topic,omitempty"`
+	Array Array     `json:"array"`
+}
+
+// Relays the messages published by the handlers of a cluster, so a handler
+// can send arrays to the sessions and topics of the other nodes.
+type Backplane interface {
+	// Publishes the message to all the subscribers, including the ones of the
+	// publishing node.
+	Publish(m *BackplaneMessage) error
+	// Registers a function receiving the published messages. Returns a
+	// function cancelling the subscription.
+	Subscribe(f func(*BackplaneMessage)) (cancel func())
+}
+
+// The subscribers of a backplane.
+type subscribers struct {
+	sync.Mutex
+	next int
+	m    map[int]func(*BackplaneMessage)
+}
+
+func (s *subscribers) add(f func(*BackplaneMessage)) (cancel func()) {
+	s.Lock()
+	defer s.Unlock()
+	if s.m == nil {
+		s.m = make(map[int]func(*BackplaneMessage))
+	}
+	id := s.next
+	s.next++
+	s.m[id] = f
+	return func() {
+		s.Lock()
+		defer s.Unlock()
+		delete(s.m, id)
+	}
+}
+
+func (s *subscribers) deliver(m *BackplaneMessage) {
+	s.Lock()
+	fs := make([]func(*BackplaneMessage), 0, len(s.m))
+	for _, f := range s.m {
+		fs = append(fs, f)
+	}
+	s.Unlock()
+
+	for _, f := range fs {
+		f(m)
+	}
+}
+
+// A Backplane relaying the messages between the handlers of a single process.
+type LocalBackplane struct {
+	subscribers subscribers
+}
+
+func NewLocalBackplane() *LocalBackplane {
+	return &LocalBackplane{}
+}
+
+func (b *LocalBackplane) Publish(m *BackplaneMessage) error {
+	b.subscribers.deliver(m)
+	return nil
+}
+
+func (b *LocalBackplane) Subscribe(f func(*BackplaneMessage)) (cancel func()) {
+	return b.subscribers.add(f)
+}
+
+// A Backplane relaying the messages through a TCP backplane server, see
+// ServeBackplane. The messages are exchanged as JSON objects separated by new
+// lines. The connection is reestablished when lost or when a message can't be
+// written in time, and the messages published while disconnected are refused.
+type TCPBackplane struct {
+	addr         string
+	subscribers  subscribers
+	writeTimeout time.Duration
+
+	lock   sync.Mutex
+	conn   net.Conn
+	closed bool
+}
+
+// Connects to the TCP backplane server listening on the given address.
+func DialBackplane(addr string) (b *TCPBackplane, err error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	b = &TCPBackplane{addr: addr, conn: conn, writeTimeout: backplaneWriteTimeout}
+	go b.receive(conn)
+	return
+}
+
+func (b *TCPBackplane) Publish(m *BackplaneMessage) (err error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return errBackplaneClosed
+	} else if b.conn == nil {
+		return errBackplaneDisconnected
+	}
+
+	// A message partially written on a connection that timed out can't be
+	// completed, so the connection is closed and then replaced by receive.
+	b.conn.SetWriteDeadline(time.Now().Add(b.writeTimeout))
+	if _, err = b.conn.Write(append(data, '\n')); err != nil {
+		log.Printf("backplane: %s\n", err)
+		b.conn.Close()
+		b.conn = nil
+	}
+	return
+}
+
+func (b *TCPBackplane) Subscribe(f func(*BackplaneMessage)) (cancel func()) {
+	return b.subscribers.add(f)
+}
+
+// Closes the connection to the backplane server.
+func (b *TCPBackplane) Close() (err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	if b.conn != nil {
+		err = b.conn.Close()
+		b.conn = nil
+	}
+	return
+}
+
+// Delivers the messages received on the connection to the subscribers and
+// reconnects once the connection is lost.
+func (b *TCPBackplane) receive(conn net.Conn) {
+	for {
+		scanner := bufio.NewScanner(conn)
+		scanner.Buffer(nil, maxWebSocketMessageSize)
+		for scanner.Scan() {
+			m := new(BackplaneMessage)
+			if err := json.Unmarshal(scanner.Bytes(), m); err != nil {
+				log.Printf("backplane: bad message: %s\n", err)
+				continue
+			}
+			b.subscribers.deliver(m)
+		}
+
+		if conn = b.redial(conn); conn == nil {
+			return
+		}
+	}
+}
+
+// Replaces the lost connection. Returns nil once the backplane is closed.
+func (b *TCPBackplane) redial(lost net.Conn) net.Conn {
+	b.lock.Lock()
+	if b.conn == lost {
+		b.conn = nil
+	}
+	b.lock.Unlock()
+	lost.Close()
+
+	for {
+		b.lock.Lock()
+		closed := b.closed
+		b.lock.Unlock()
+		if closed {
+			return nil
+		}
+
+		conn, err := net.Dial("tcp", b.addr)
+		if err != nil {
+			log.Printf("backplane: %s\n", err)
+			time.Sleep(backplaneRedialDelay)
+			continue
+		}
+
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if b.closed {
+			conn.Close()
+			return nil
+		}
+		b.conn = conn
+		return conn
+	}
+}
+
+// Serves the TCP backplane on the listener. Every message received on a
+// connection is relayed to all the connections, including the one it was
+// received on.
+func ServeBackplane(l net.Listener) error {
+	var lock sync.Mutex
+	conns := make(map[net.Conn]chan []byte)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		out := make(chan []byte, backplaneConnBuffer)
+		lock.Lock()
+		conns[conn] = out
+		lock.Unlock()
+
+		go func() {
+			for data := range out {
+				if _, err := conn.Write(data); err != nil {
+					break
+				}
+			}
+			conn.Close()
+		}()
+
+		go func() {
+			scanner := bufio.NewScanner(conn)
+			scanner.Buffer(nil, maxWebSocketMessageSize)
+			for scanner.Scan() {
+				data := append(scanner.Bytes(), '\n')
+				lock.Lock()
+				for c, out := range conns {
+					select {
+					case out <- append([]byte(nil), data...):
+					default:
+						log.Printf("backplane: dropping slow connection %s\n", c.RemoteAddr())
+						delete(conns, c)
+						close(out)
+					}
+				}
+				lock.Unlock()
+			}
+
+			lock.Lock()
+			if out, ok := conns[conn]; ok {
+				delete(conns, conn)
+				close(out)
+			}
+			lock.Unlock()
+		}()
+	}
+}
+
+// Subscribes the channel to the topic. See Handler.Publish.
+func (c *Channel) Subscribe(topic string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.topics == nil {
+		c.topics = make(map[string]bool)
+	}
+	c.topics[topic] = true
+}
+
+// Unsubscribes the channel from the topic.
+func (c *Channel) Unsubscribe(topic string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.topics, topic)
+}
+
+func (c *Channel) subscribed(topic string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.topics[topic]
+}
+
+// Sets the backplane relaying the arrays sent with SendTo and Publish to the
+// other nodes of the cluster, and subscribes the handler to it.
+func (h *Handler) SetBackplane(backplane Backplane) {
+	if h.unsubscribe != nil {
+		h.unsubscribe()
+	}
+	h.backplane = backplane
+	h.unsubscribe = backplane.Subscribe(h.receiveBackplaneMessage)
+}
+
+func (h *Handler) receiveBackplaneMessage(m *BackplaneMessage) {
+	if m.Sid != nullSessionId {
+		if channel := h.channels.get(m.Sid); channel != nil {
+			channel.SendArray(m.Array)
+		}
+	} else {
+		h.publishLocal(m.Topic, m.Array)
+	}
+}
+
+// Sends the array to the session, which may be owned by another node when the
+// handler has a backplane. Returns ErrUnknownSession if the handler doesn't
+// have a backplane and doesn't own the session.
+func (h *Handler) SendTo(sid SessionId, array Array) error {
+	if channel := h.channels.get(sid); channel != nil {
+		return channel.SendArray(array)
+	} else if h.backplane != nil {
+		return h.backplane.Publish(&BackplaneMessage{Sid: sid, Array: array})
+	}
+	return ErrUnknownSession
+}
+
+// Sends the array to the channels subscribed to the topic, on all the nodes
+// when the handler has a backplane. See Channel.Subscribe.
+func (h *Handler) Publish(topic string, array Array) error {
+	if h.backplane != nil {
+		return h.backplane.Publish(&BackplaneMessage{Topic: topic, Array: array})
+	}
+	h.publishLocal(topic, array)
+	return nil
+}
+
+func (h *Handler) publishLocal(topic string, array Array) {
+	h.channels.RLock()
+	channels := make([]*Channel, 0, len(h.channels.m))
+	for _, channel := range h.channels.m {
+		channels = append(channels, channel)
+	}
+	h.channels.RUnlock()
+
+	for _, channel := range channels {
+		if channel.subscribed(topic) {
+			channel.SendArray(array)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"crypto/rand"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Creates a handler owning a test channel.
+func newBackplaneTestHandler(backplane Backplane) (*Handler, *Channel, *fakeBackChannel) {
+	h := NewHandler(func(*Channel) {})
+	if backplane != nil {
+		h.SetBackplane(backplane)
+	}
+	sid, _ := generateSesionId(rand.Reader)
+	c := newChannel("8", sid, make(chan SessionId, 1), "", channelSettings{})
+	c.armChannelTimeout()
+	bc := &fakeBackChannel{}
+	c.setBackChannel(bc)
+	bc.chunks = nil
+	h.channels.set(c.Sid, c)
+	return h, c, bc
+}
+
+func TestSendToWithoutBackplane(t *testing.T) {
+	h, c, bc := newBackplaneTestHandler(nil)
+	defer c.terminate(CloseClientTerminated)
+
+	if err := h.SendTo(c.Sid, Array{"a"}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := h.SendTo(SessionId{1}, Array{"b"}); err != ErrUnknownSession {
+		t.Errorf("expected ErrUnknownSession, got %v", err)
+	}
+
+	expected := []string{`[[2,["a"]]]`}
+	if chunks := bc.getChunks(); !equalStrings(chunks, expected) {
+		t.Errorf("expected %v, got %v", expected, chunks)
+	}
+}
+
+func TestLocalBackplane(t *testing.T) {
+	backplane := NewLocalBackplane()
+	h1, c1, bc1 := newBackplaneTestHandler(backplane)
+	h2, c2, bc2 := newBackplaneTestHandler(backplane)
+	defer c1.terminate(CloseClientTerminated)
+	defer c2.terminate(CloseClientTerminated)
+
+	c2.Subscribe("news")
+
+	h1.SendTo(c2.Sid, Array{"direct"})
+	h1.Publish("news", Array{"news"})
+	h2.Publish("other", Array{"other"})
+
+	if chunks := bc1.getChunks(); len(chunks) != 0 {
+		t.Errorf("expected nothing on the first channel, got %v", chunks)
+	}
+
+	expected := []string{`[[2,["direct"]]]`, `[[3,["news"]]]`}
+	if chunks := bc2.getChunks(); !equalStrings(chunks, expected) {
+		t.Errorf("expected %v, got %v", expected, chunks)
+	}
+
+	// The handler doesn't receive the messages once shut down.
+	h2.Shutdown()
+	h1.Publish("news", Array{"late"})
+	if chunks := bc2.getChunks(); len(chunks) != 3 {
+		t.Errorf("expected the close array only, got %v", chunks)
+	}
+}
+
+func TestTCPBackplane(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go ServeBackplane(l)
+
+	received := make(chan *BackplaneMessage, 10)
+
+	b1, err := DialBackplane(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b1.Close()
+	b1.Subscribe(func(m *BackplaneMessage) { received <- m })
+
+	b2, err := DialBackplane(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Close()
+	b2.Subscribe(func(m *BackplaneMessage) { received <- m })
+
+	// Wait for the server to accept both connections.
+	time.Sleep(50 * time.Millisecond)
+
+	sid, _ := generateSesionId(rand.Reader)
+	sent := &BackplaneMessage{Sid: sid, Array: Array{"a", 1.0}}
+	if err := b1.Publish(sent); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-received:
+			if !reflect.DeepEqual(m, sent) {
+				t.Errorf("expected %#v, got %#v", sent, m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected both subscribers to receive the message")
+		}
+	}
+
+	b1.Close()
+	if err := b1.Publish(sent); err != errBackplaneClosed {
+		t.Errorf("expected errBackplaneClosed, got %v", err)
+	}
+}
+
+func TestTCPBackplaneSlowServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// A server that never reads its connections.
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+
+	b, err := DialBackplane(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.writeTimeout = 50 * time.Millisecond
+
+	first := <-conns
+	defer first.Close()
+
+	m := &BackplaneMessage{Array: Array{string(make([]byte, 1<<16))}}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := b.Publish(m); err != nil {
+			if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+				t.Fatalf("expected a timeout, got %v", err)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected publish to time out")
+		}
+	}
+
+	select {
+	case conn := <-conns:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the backplane to reconnect")
+	}
+}
@@ -4,6 +4,7 @@
 package browserchannel
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,15 +15,36 @@ import (
 
 var (
 	ErrClosed = errors.New("channel closed")
+
+	errPendingMapsFull = errors.New("pending maps full")
 )
 
 const (
-	maxOutgoingArrays          = 100
+	maxOutgoingArrays = 100
+	maxPendingMaps    = 100
+	// The capacity of the queue holding the maps received out of order when
+	// the map limits allow fewer maps per request.
+	defaultMapQueueCapacity = 100
+	// The time a request carrying maps waits for the application to catch
+	// up when the pending maps are full.
+	pendingMapsTimeout         = 10 * time.Second
 	channelReopenTimeoutDelay  = 20 * time.Second
 	backChannelExpirationDelay = 3 * time.Minute
-	backChannelHeartbeatDelay  = 30 * time.Second
+	// The time allowed for each write made on a back channel.
+	backChannelWriteTimeout   = 10 * time.Second
+	backChannelHeartbeatDelay = 30 * time.Second
 )
 
+// The channel states. The transitions are:
+//
+//	channelInit -> channelReady        the first back channel is set
+//	channelInit -> channelWriteClosed  the channel is closed by the server
+//	channelReady -> channelWriteClosed the channel is closed by the server
+//	any state -> channelClosed         the stop array was sent, the client
+//	                                   terminated the channel or the channel
+//	                                   timed out
+//
+// Closing a channel that is write closed or closed has no effect.
 type channelState int
 
 const (
@@ -39,63 +61,134 @@ type Array []interface{}
 type outgoingArray struct {
 	index    int
 	elements Array
+	// The JSON representation of the elements.
+	data      json.RawMessage
+	droppable bool
+	key       string
 }
 
 var (
 	noopArray = Array{"noop"}
-	stopArray = Array{"stop"}
 )
 
 func marshalOutgoingArrays(arrays []*outgoingArray) (data []byte, err error) {
 	carrays := []interface{}{}
 	for _, a := range arrays {
-		carrays = append(carrays, []interface{}{a.index, a.elements})
+		carrays = append(carrays, []interface{}{a.index, a.data})
 	}
 	data, err = json.Marshal(carrays)
 	return
 }
 
+// Channel settings derived from the handler configuration.
+type channelSettings struct {
+	// Delay during which the outgoing arrays are accumulated before being
+	// sent. Coalescing is disabled when zero.
+	coalesceDelay time.Duration
+	// Number of accumulated bytes triggering an immediate flush. Ignored
+	// when zero.
+	coalesceBytes int
+	// Limits of the outgoing queue.
+	queueLimits QueueLimits
+	// The maximum number of concurrent back channel requests. Ignored when
+	// zero.
+	maxBackChannels int
+	// The capacity of the queue holding the incoming maps, which has to fit
+	// the largest request allowed by the map limits. defaultMapQueueCapacity
+	// when zero.
+	mapQueueCapacity int
+	// The time allowed for the client to open a new back channel before the
+	// channel is terminated, channelReopenTimeoutDelay when zero.
+	reopenTimeout time.Duration
+	// The callback receiving the bad maps. Ignored when nil.
+	badMapHandler BadMapHandler
+	// The store persisting the outgoing arrays. Ignored when nil.
+	store OutgoingStore
+	// Whether the non-ASCII characters of the outgoing arrays are escaped.
+	asciiOnly bool
+	// The interceptors of the incoming maps and of the outgoing arrays.
+	mapInterceptors   []MapInterceptor
+	arrayInterceptors []ArrayInterceptor
+}
+
 type Channel struct {
-	// The client specific version string.
+	// The client specific version string, i.e. the CVER parameter of the
+	// initial bind request or the protocol version if it wasn't set.
 	Version string
 	// The channel session id.
 	Sid   SessionId
 	state channelState
 
-	backChannel backChannel
-	corsInfo    *crossDomainInfo
+	backChannel  backChannel
+	backChannels int
+	hostPrefix   string
+	settings     channelSettings
+	clientKey    string
+	request      *RequestInfo
+	// The session id sent to the client, which is signed when the handler
+	// has a SessionIdSigner.
+	sidString string
+	topics    map[string]bool
 
 	maps           *mapQueue
 	outgoingArrays []*outgoingArray
+	outgoingBytes  int
+	closeReason    *CloseReason
 
 	lastArrayId     int
 	lastSentArrayId int
 
+	// The operations of the outgoing store waiting to be performed and
+	// whether a goroutine is performing them.
+	storeOps        []func(OutgoingStore)
+	storeOpsRunning bool
+
 	channelTimeout        *time.Timer
+	flushTimer            *time.Timer
 	backChannelExpiration *time.Timer
 	backChannelHeartbeat  *time.Ticker
 
-	heartbeatStop chan bool
-	gcChan        chan<- SessionId
-	mapChan       chan Map
+	gcChan  chan<- SessionId
+	mapChan chan Map
+	// Maps waiting to be delivered on the map channel, the signal used to
+	// wake up the goroutine delivering them and the signal it sends when it
+	// takes them.
+	pendingMaps []*pendingMap
+	mapsReady   chan bool
+	mapsTaken   chan bool
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
 
 	lock sync.Mutex
 }
 
 func newChannel(clientVersion string, sid SessionId, gcChan chan<- SessionId,
-	corsInfo *crossDomainInfo) (c *Channel) {
-	return &Channel{
+	hostPrefix string, settings channelSettings) (c *Channel) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	capacity := settings.mapQueueCapacity
+	if capacity == 0 {
+		capacity = defaultMapQueueCapacity
+	}
+	c = &Channel{
 		Version:              clientVersion,
 		Sid:                  sid,
+		sidString:            sid.String(),
 		state:                channelInit,
-		corsInfo:             corsInfo,
-		maps:                 newMapQueue(100 /* capacity */),
+		hostPrefix:           hostPrefix,
+		settings:             settings,
+		maps:                 newMapQueue(capacity),
 		outgoingArrays:       []*outgoingArray{},
 		backChannelHeartbeat: time.NewTicker(backChannelHeartbeatDelay),
-		heartbeatStop:        make(chan bool, 1),
 		mapChan:              make(chan Map, 100),
+		mapsReady:            make(chan bool, 1),
+		mapsTaken:            make(chan bool, 1),
 		gcChan:               gcChan,
+		ctx:                  ctx,
+		cancel:               cancel,
 	}
+	go c.deliverMaps()
+	return
 }
 
 func (c *Channel) log(format string, v ...interface{}) {
@@ -103,8 +196,71 @@ func (c *Channel) log(format string, v ...interface{}) {
 }
 
 // Sends an array on the channel. Will return an error if the channel isn't
-// ready, i.e. initializing or closed.
-func (c *Channel) SendArray(array Array) (err error) {
+// ready, i.e. initializing or closed, if the array can't be serialized to
+// JSON or if the outgoing queue is full. When coalescing is enabled, the array
+// may be sent later along with other arrays.
+func (c *Channel) SendArray(array Array) error {
+	return c.SendArrayWithOptions(array, SendOptions{})
+}
+
+// Sends an array on the channel as SendArray does, using the given options to
+// queue the array.
+func (c *Channel) SendArrayWithOptions(array Array, opts SendOptions) error {
+	array, err := c.interceptArray(array)
+	if array == nil || err != nil {
+		return err
+	}
+	return c.sendArray(array, opts, true /* durable */)
+}
+
+// Sends an array, persisting it in the outgoing store when durable is true.
+func (c *Channel) sendArray(array Array, opts SendOptions, durable bool) (err error) {
+	defer c.performStoreOps()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state != channelReady {
+		err = ErrClosed
+		return
+	}
+
+	data, err := json.Marshal(array)
+	if err != nil {
+		return
+	}
+
+	if err = c.makeRoom(len(data), opts.Key); err != nil {
+		return
+	}
+
+	if len(opts.Key) > 0 {
+		c.replaceArrays(opts.Key)
+	}
+
+	c.appendArray(array, data, opts)
+
+	id := c.lastArrayId
+	if durable {
+		c.queueStoreOp(func(store OutgoingStore) {
+			if err := store.Append(c.Sid, &StoredArray{id, data}); err != nil {
+				c.log("store array %d: %s", id, err)
+			}
+		})
+	} else {
+		c.queueAdvanceOp()
+	}
+
+	if c.settings.coalesceDelay > 0 {
+		c.coalesce()
+	} else {
+		c.flush()
+	}
+	return
+}
+
+// Sends the arrays accumulated while coalescing immediately. Intended for
+// latency sensitive arrays. Will return an error if the channel isn't ready.
+func (c *Channel) Flush() (err error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
@@ -113,26 +269,87 @@ func (c *Channel) SendArray(array Array) (err error) {
 		return
 	}
 
-	c.queueArray(array)
 	c.flush()
 	return
 }
 
-func (c *Channel) queueArray(a Array) {
+// Queues an array regardless of the queue limits.
+func (c *Channel) queueArray(a Array) (err error) {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return
+	}
+
+	c.appendArray(a, data, SendOptions{})
+	c.queueAdvanceOp()
+	return
+}
+
+// Records the id of the last array, which isn't persisted.
+func (c *Channel) queueAdvanceOp() {
+	id := c.lastArrayId
+	c.queueStoreOp(func(store OutgoingStore) {
+		if err := store.Advance(c.Sid, id); err != nil {
+			c.log("store advance %d: %s", id, err)
+		}
+	})
+}
+
+func (c *Channel) appendArray(a Array, data []byte, opts SendOptions) {
 	c.lastArrayId++
-	outgoingArray := &outgoingArray{c.lastArrayId, a}
+	outgoingArray := &outgoingArray{c.lastArrayId, a, data, opts.Droppable, opts.Key}
 	c.outgoingArrays = append(c.outgoingArrays, outgoingArray)
+	c.outgoingBytes += len(data)
+}
+
+// Returns the number of arrays that weren't sent on the current back channel
+// and their size in bytes.
+func (c *Channel) unsentArrays() (count int, size int) {
+	unsent := c.outgoingArrays[c.firstUnsentArray():]
+	for _, a := range unsent {
+		size += len(a.data)
+	}
+	return len(unsent), size
+}
+
+// Delays the flush of the outgoing arrays until the coalescing delay expires
+// or enough bytes are accumulated.
+func (c *Channel) coalesce() {
+	if _, size := c.unsentArrays(); c.settings.coalesceBytes > 0 &&
+		size >= c.settings.coalesceBytes {
+		c.flush()
+		return
+	}
+
+	if c.flushTimer == nil {
+		c.flushTimer = time.AfterFunc(c.settings.coalesceDelay, func() {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+
+			c.flushTimer = nil
+			if c.state != channelClosed {
+				c.flush()
+			}
+		})
+	}
 }
 
 func (c *Channel) flush() {
-	numUnsentArrays := c.lastArrayId - c.lastSentArrayId
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
 
-	if c.backChannel == nil || numUnsentArrays == 0 {
+	next := c.firstUnsentArray()
+
+	if c.backChannel == nil || next == len(c.outgoingArrays) {
 		return
 	}
 
-	next := len(c.outgoingArrays) - numUnsentArrays
 	data, _ := marshalOutgoingArrays(c.outgoingArrays[next:])
+	if c.settings.asciiOnly {
+		data = escapeNonAscii(data)
+	}
 
 	// If an error occurs when sending the data, the back channel will become
 	// non-reusable in which case it will be discarded to force the client to
@@ -152,7 +369,8 @@ func (c *Channel) flush() {
 	// If the number of buffered outgoing arrays is greater than a given
 	// threshold, force a back channel change to get acknowledgments so
 	// we can free some of them later.
-	if !c.backChannel.isReusable() || len(c.outgoingArrays) > 100 {
+	if !c.backChannel.isReusable() ||
+		(!c.backChannel.isPersistent() && len(c.outgoingArrays) > maxOutgoingArrays) {
 		c.log("discarding back channel")
 		c.clearBackChannel(false /* permanent */)
 	}
@@ -169,32 +387,63 @@ func (c *Channel) Maps() <-chan Map {
 // the client before shutting down the channel permanently. SendArray calls will
 // return an error after the channel has been closed.
 func (c *Channel) Close() {
+	c.CloseWithReason(CloseServerClosed, "")
+}
+
+// Close the channel from the server side as Close does. The code and the
+// message are reported by CloseReason and sent to the client in the stop
+// array: ["stop", code, message].
+func (c *Channel) CloseWithReason(code CloseCode, message string) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	c.closeInternal(code, message)
+}
+
+func (c *Channel) closeInternal(code CloseCode, message string) {
+	if c.state == channelWriteClosed || c.state == channelClosed {
+		return
+	}
+
+	// The client expects the 'c' array before any other array, so a channel
+	// closed before its first back channel sends both.
+	if c.state == channelInit {
+		c.queueConfigArray()
+	}
+
+	c.setCloseReason(code, message)
+	c.cancel(c.closeReason)
 	c.state = channelWriteClosed
-	c.queueArray(stopArray)
+	c.queueArray(Array{"stop", code, message})
 	c.flush()
-	close(c.mapChan)
 }
 
-// Close the channel after a query terminate was received from the client.
-// Intended to be called from the channel handler.
-func (c *Channel) terminate() {
+// Close the channel after a query terminate was received from the client, the
+// channel timed out or the client didn't respect the protocol.
+func (c *Channel) terminate(code CloseCode) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	c.setCloseReason(code, "")
 	c.terminateInternal()
 }
 
 func (c *Channel) terminateInternal() {
-	if c.state == channelInit || c.state == channelReady {
-		close(c.mapChan)
+	if c.state == channelClosed {
+		return
 	}
 
-	c.clearBackChannel(true /* permanent */)
-	c.heartbeatStop <- true
+	c.setCloseReason(CloseServerClosed, "")
+	c.cancel(c.closeReason)
 	c.state = channelClosed
+
+	c.clearBackChannel(true /* permanent */)
+	c.clearChannelTimeout()
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+	c.backChannelHeartbeat.Stop()
 	c.gcChan <- c.Sid
 }
 
@@ -215,44 +464,195 @@ func (c *Channel) getState() []int {
 	return []int{backChannel, c.lastSentArrayId, outstanding}
 }
 
-func (c *Channel) receiveMaps(offset int, maps []Map) (err error) {
+// Receives the maps of a forward channel request. The bad maps are left nil in
+// the maps slice and are passed to the bad map handler once, even if the
+// client sends them again.
+func (c *Channel) receiveMaps(req *RequestInfo, offset int, maps []Map, bad []*BadMap) (err error) {
 	if len(maps) == 0 {
 		return
 	}
 
 	c.lock.Lock()
-	defer c.lock.Unlock()
 
-	if c.state == channelReady {
-		c.log("receive %v", maps)
-		err = c.maps.enqueue(offset, maps)
-		c.dequeueMaps()
-	} else {
+	if c.state != channelInit && c.state != channelReady {
 		c.log("drop %v; channel isn't ready", maps)
+		c.lock.Unlock()
+		return
+	}
+
+	// Refuse the maps while the application is lagging behind. The client
+	// will send them again later.
+	if len(c.pendingMaps) >= maxPendingMaps {
+		c.lock.Unlock()
+		return errPendingMapsFull
+	}
+
+	var received []*BadMap
+	for _, b := range bad {
+		if !c.maps.received(b.Id) {
+			received = append(received, b)
+		}
+	}
+
+	c.log("receive %v", maps)
+	if err = c.maps.enqueue(offset, maps); err != nil {
+		received = nil
 	}
+	c.dequeueMaps(req)
+	c.lock.Unlock()
 
+	for _, b := range received {
+		c.log("bad map %d: %s", b.Id, b.Err)
+		if c.settings.badMapHandler != nil {
+			c.settings.badMapHandler(c, b)
+		}
+	}
 	return
 }
 
-func (c *Channel) dequeueMaps() {
+// Receives the maps of a request, waiting for the application to catch up
+// while the pending maps are full. Gives up with errPendingMapsFull once the
+// context is done or after pendingMapsTimeout, in which case the client has
+// to send the maps again. The other errors, e.g. errCapacityExceeded when the
+// maps can't fit in the map queue, are returned immediately since waiting
+// wouldn't help.
+func (c *Channel) receiveMapsWait(ctx context.Context, req *RequestInfo, offset int, maps []Map, bad []*BadMap) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, pendingMapsTimeout)
+	defer cancel()
+
 	for {
-		if m, ok := c.maps.dequeue(); ok {
-			// TODO: Make this a non-blocking operation if there is no reader.
-			c.mapChan <- m
-		} else {
+		if err = c.receiveMaps(req, offset, maps, bad); err != errPendingMapsFull {
+			return
+		}
+		select {
+		case <-c.mapsTaken:
+		case <-c.ctx.Done():
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Moves the maps that can be delivered in order to the pending maps. The maps
+// are attributed to the request that completed the sequence.
+func (c *Channel) dequeueMaps(req *RequestInfo) {
+	dequeued := false
+	for {
+		id := c.maps.next
+		if m, ok := c.maps.dequeue(); !ok {
 			break
+		} else if m != nil {
+			c.pendingMaps = append(c.pendingMaps, &pendingMap{id, m, req})
+			dequeued = true
+		}
+	}
+
+	if dequeued {
+		select {
+		case c.mapsReady <- true:
+		default:
+		}
+	}
+}
+
+// Delivers the pending maps in order on the map channel and closes the map
+// channel once the channel is closed. Delivering the maps from a dedicated
+// goroutine guarantees that the channel lock is never held while waiting for
+// the application to read its maps. The maps that can't be delivered without
+// blocking after the channel was closed are dropped.
+func (c *Channel) deliverMaps() {
+	defer close(c.mapChan)
+
+	for {
+		c.lock.Lock()
+		maps := c.pendingMaps
+		c.pendingMaps = nil
+		c.lock.Unlock()
+
+		if len(maps) > 0 {
+			select {
+			case c.mapsTaken <- true:
+			default:
+			}
+		}
+
+		for i, p := range maps {
+			m := c.interceptMap(p)
+			if m == nil {
+				continue
+			}
+			select {
+			case c.mapChan <- m:
+			case <-c.ctx.Done():
+				c.dropMaps(maps[i+1:], m)
+				return
+			}
+		}
+
+		select {
+		case <-c.mapsReady:
+		case <-c.ctx.Done():
+			c.lock.Lock()
+			maps = c.pendingMaps
+			c.pendingMaps = nil
+			c.lock.Unlock()
+			c.dropMaps(maps, nil)
+			return
+		}
+	}
+}
+
+// Delivers the maps that fit in the map channel buffer, starting with the
+// intercepted map that couldn't be delivered, if any, and drops the others.
+func (c *Channel) dropMaps(maps []*pendingMap, intercepted Map) {
+	if intercepted != nil {
+		select {
+		case c.mapChan <- intercepted:
+		default:
+			c.log("drop %d maps; channel closed", len(maps)+1)
+			return
+		}
+	}
+	for i, p := range maps {
+		m := c.interceptMap(p)
+		if m == nil {
+			continue
+		}
+		select {
+		case c.mapChan <- m:
+		default:
+			c.log("drop %d maps; channel closed", len(maps)-i)
+			return
 		}
 	}
 }
 
 func (c *Channel) acknowledgeArrays(aid int) {
+	defer c.performStoreOps()
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
 	c.log("acknowledge %d", aid)
 
+	// Arrays that weren't sent can't be acknowledged.
+	if aid > c.lastSentArrayId {
+		aid = c.lastSentArrayId
+	}
+
+	acknowledged := false
 	for len(c.outgoingArrays) > 0 && c.outgoingArrays[0].index <= aid {
+		c.outgoingBytes -= len(c.outgoingArrays[0].data)
 		c.outgoingArrays = c.outgoingArrays[1:]
+		acknowledged = true
+	}
+
+	if acknowledged {
+		c.queueStoreOp(func(store OutgoingStore) {
+			if err := store.Acknowledge(c.Sid, aid); err != nil {
+				c.log("store acknowledge %d: %s", aid, err)
+			}
+		})
 	}
 
 	// Make sure to release the reference to the underlying array by copying
@@ -264,6 +664,7 @@ func (c *Channel) acknowledgeArrays(aid int) {
 
 // Sets or replaces the back channel.
 func (c *Channel) setBackChannel(bc backChannel) {
+	defer c.performStoreOps()
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
@@ -275,9 +676,8 @@ func (c *Channel) setBackChannel(bc backChannel) {
 	c.log("set back channel [rid:%s, chunked:%t]", bc.getRequestId(), bc.isChunked())
 
 	if c.state == channelInit {
-		go heartbeat(c, c.backChannelHeartbeat.C, c.heartbeatStop)
-		hostPrefix := getHostPrefix(c.corsInfo)
-		c.queueArray(Array{"c", c.Sid.String(), hostPrefix, 8})
+		go heartbeat(c, c.backChannelHeartbeat.C, c.ctx.Done())
+		c.queueConfigArray()
 		c.state = channelReady
 	}
 
@@ -288,17 +688,80 @@ func (c *Channel) setBackChannel(bc backChannel) {
 
 	c.backChannel = bc
 	c.clearChannelTimeout()
-	c.armBackChannelTimeouts()
+	if !bc.isPersistent() {
+		c.armBackChannelTimeouts()
+	}
 
 	// Special care is needed to account for the fact that the old back
 	// channel may have died uncleanly. To make sure that all arrays are
 	// effectively received by the client, the last sent array id is reset
 	// to the last unacknowledged array id.
+	c.rewind()
+
+	c.flush()
+}
+
+// Queues the 'c' array carrying the session id, the host prefix and the
+// protocol version: ['c', id, host, version].
+func (c *Channel) queueConfigArray() {
+	c.queueArray(Array{"c", c.sidString, c.hostPrefix, SupportedProcolVersion})
+}
+
+// Resets the last sent array id to the last acknowledged array id so the
+// unacknowledged arrays are sent again.
+func (c *Channel) rewind() {
 	if len(c.outgoingArrays) > 0 {
 		c.lastSentArrayId = c.outgoingArrays[0].index - 1
 	}
+}
 
-	c.flush()
+// Clears the given back channel after its request was cancelled or a write
+// failed. The reopen timeout starts right away and the forward channel
+// responses tell the client that the back channel is missing and which arrays
+// it didn't receive.
+func (c *Channel) failBackChannel(bc backChannel) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.backChannel == bc {
+		c.log("back channel %s failed", bc.getRequestId())
+		c.clearBackChannel(false /* permanent */)
+		c.rewind()
+	}
+}
+
+// Registers a back channel request. Returns false if the maximum number of
+// concurrent back channel requests is reached. Requests whose back channel
+// was replaced count until their handler returns, e.g. while a write to a
+// dead connection is pending.
+func (c *Channel) acquireBackChannel() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.settings.maxBackChannels > 0 && c.backChannels >= c.settings.maxBackChannels {
+		return false
+	}
+	c.backChannels++
+	return true
+}
+
+func (c *Channel) releaseBackChannel() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.backChannels--
+}
+
+// Clears the given back channel if it is still the current one, e.g. after
+// its underlying connection was lost.
+func (c *Channel) removeBackChannel(bc backChannel) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.backChannel == bc {
+		c.log("remove back channel %s", bc.getRequestId())
+		c.clearBackChannel(false /* permanent */)
+	}
 }
 
 // Clear back channel and starts the channel session timeout if the permanent
@@ -332,14 +795,14 @@ func (c *Channel) armBackChannelTimeouts() {
 	})
 }
 
-func heartbeat(c *Channel, ticks <-chan time.Time, stops <-chan bool) {
+func heartbeat(c *Channel, ticks <-chan time.Time, stops <-chan struct{}) {
 	c.log("start heartbeats")
 
 	for {
 		select {
 		case <-ticks:
 			c.log("heartbeat")
-			c.SendArray(noopArray)
+			c.sendArray(noopArray, SendOptions{}, false /* durable */)
 		case <-stops:
 			c.log("stop heartbeats")
 			return
@@ -348,18 +811,27 @@ func heartbeat(c *Channel, ticks <-chan time.Time, stops <-chan bool) {
 }
 
 func (c *Channel) clearBackChannelTimeouts() {
-	c.backChannelExpiration.Stop()
-	c.backChannelExpiration = nil
+	if c.backChannelExpiration != nil {
+		c.backChannelExpiration.Stop()
+		c.backChannelExpiration = nil
+	}
 }
 
 func (c *Channel) armChannelTimeout() {
-	c.channelTimeout = time.AfterFunc(channelReopenTimeoutDelay, func() {
+	c.clearChannelTimeout()
+	timeout := c.settings.reopenTimeout
+	if timeout == 0 {
+		timeout = channelReopenTimeoutDelay
+	}
+	c.channelTimeout = time.AfterFunc(timeout, func() {
 		c.log("channel timeout")
-		c.terminate()
+		c.terminate(CloseReopenTimeout)
 	})
 }
 
 func (c *Channel) clearChannelTimeout() {
-	c.channelTimeout.Stop()
-	c.channelTimeout = nil
+	if c.channelTimeout != nil {
+		c.channelTimeout.Stop()
+		c.channelTimeout = nil
+	}
 }
@@ -0,0 +1,392 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A back channel recording the chunks sent on it.
+type fakeBackChannel struct {
+	sync.Mutex
+	chunks    []string
+	discarded bool
+}
+
+func (b *fakeBackChannel) getRequestId() string           { return "fake" }
+func (b *fakeBackChannel) isReusable() bool               { return true }
+func (b *fakeBackChannel) isPersistent() bool             { return false }
+func (b *fakeBackChannel) setChunked(bool)                {}
+func (b *fakeBackChannel) isChunked() bool                { return true }
+func (b *fakeBackChannel) wait(context.Context, *Channel) {}
+
+func (b *fakeBackChannel) send(data []byte) error {
+	b.Lock()
+	defer b.Unlock()
+	b.chunks = append(b.chunks, string(data))
+	return nil
+}
+
+func (b *fakeBackChannel) discard() {
+	b.Lock()
+	defer b.Unlock()
+	b.discarded = true
+}
+
+func (b *fakeBackChannel) getChunks() []string {
+	b.Lock()
+	defer b.Unlock()
+	return append([]string{}, b.chunks...)
+}
+
+// Creates a ready channel with a fake back channel on which the channel
+// configuration array was already sent.
+func newTestChannel(settings channelSettings) (*Channel, *fakeBackChannel) {
+	gcChan := make(chan SessionId, 1)
+	c := newChannel("8", SessionId{}, gcChan, "", settings)
+	c.armChannelTimeout()
+	bc := &fakeBackChannel{}
+	c.setBackChannel(bc)
+	bc.chunks = nil
+	return c, bc
+}
+
+func TestSendArray(t *testing.T) {
+	c, bc := newTestChannel(channelSettings{})
+	defer c.terminate(CloseClientTerminated)
+
+	c.SendArray(Array{"a"})
+	c.SendArray(Array{"b"})
+
+	expected := []string{`[[2,["a"]]]`, `[[3,["b"]]]`}
+	if chunks := bc.getChunks(); !equalStrings(chunks, expected) {
+		t.Errorf("expected %v, got %v", expected, chunks)
+	}
+}
+
+func TestSendArrayInvalid(t *testing.T) {
+	c, _ := newTestChannel(channelSettings{})
+	defer c.terminate(CloseClientTerminated)
+
+	if err := c.SendArray(Array{make(chan int)}); err == nil {
+		t.Error("expected an error for an array that can't be serialized")
+	}
+}
+
+func TestCoalesceDelay(t *testing.T) {
+	c, bc := newTestChannel(channelSettings{coalesceDelay: 50 * time.Millisecond})
+	defer c.terminate(CloseClientTerminated)
+
+	c.SendArray(Array{"a"})
+	c.SendArray(Array{"b"})
+
+	if chunks := bc.getChunks(); len(chunks) != 0 {
+		t.Fatalf("expected arrays to be delayed, got %v", chunks)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	expected := []string{`[[2,["a"]],[3,["b"]]]`}
+	if chunks := bc.getChunks(); !equalStrings(chunks, expected) {
+		t.Errorf("expected %v, got %v", expected, chunks)
+	}
+}
+
+func TestCoalesceBytes(t *testing.T) {
+	c, bc := newTestChannel(channelSettings{
+		coalesceDelay: time.Hour,
+		coalesceBytes: 10,
+	})
+	defer c.terminate(CloseClientTerminated)
+
+	c.SendArray(Array{"a"})
+	c.SendArray(Array{"bcd"})
+
+	expected := []string{`[[2,["a"]],[3,["bcd"]]]`}
+	if chunks := bc.getChunks(); !equalStrings(chunks, expected) {
+		t.Errorf("expected %v, got %v", expected, chunks)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	c, bc := newTestChannel(channelSettings{coalesceDelay: time.Hour})
+	defer c.terminate(CloseClientTerminated)
+
+	c.SendArray(Array{"a"})
+	c.Flush()
+
+	expected := []string{`[[2,["a"]]]`}
+	if chunks := bc.getChunks(); !equalStrings(chunks, expected) {
+		t.Errorf("expected %v, got %v", expected, chunks)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCloseReason(t *testing.T) {
+	c, bc := newTestChannel(channelSettings{})
+
+	if err := c.Err(); err != nil {
+		t.Fatalf("expected no error on an open channel, got %v", err)
+	}
+
+	c.CloseWithReason(CloseApplication, "logged out")
+
+	expected := &CloseReason{CloseApplication, "logged out"}
+	if reason := c.CloseReason(); *reason != *expected {
+		t.Errorf("expected %v, got %v", expected, reason)
+	}
+
+	chunks := bc.getChunks()
+	if len(chunks) != 1 || chunks[0] != `[[2,["stop",1000,"logged out"]]]` {
+		t.Errorf("expected stop array with reason, got %v", chunks)
+	}
+
+	if _, ok := <-c.Maps(); ok {
+		t.Error("expected map channel to be closed")
+	}
+}
+
+func TestTerminateReason(t *testing.T) {
+	c, _ := newTestChannel(channelSettings{})
+
+	c.terminate(CloseClientTerminated)
+
+	if err, ok := c.Err().(*CloseReason); !ok || err.Code != CloseClientTerminated {
+		t.Errorf("expected client terminated reason, got %v", c.Err())
+	}
+}
+
+func TestContext(t *testing.T) {
+	c, _ := newTestChannel(channelSettings{})
+	ctx := c.Context()
+
+	if ctx.Err() != nil {
+		t.Fatal("expected context of an open channel to be active")
+	}
+
+	c.terminate(CloseReopenTimeout)
+
+	select {
+	case <-ctx.Done():
+	default:
+		t.Fatal("expected context to be cancelled")
+	}
+
+	if cause, ok := context.Cause(ctx).(*CloseReason); !ok || cause.Code != CloseReopenTimeout {
+		t.Errorf("expected reopen timeout cause, got %v", context.Cause(ctx))
+	}
+}
+
+// Waits for the map channel to be closed.
+func waitMapsClosed(t *testing.T, c *Channel) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-c.Maps():
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for the map channel to be closed")
+		}
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	c, bc := newTestChannel(channelSettings{})
+
+	c.Close()
+	c.Close()
+	c.terminate(CloseClientTerminated)
+	c.terminate(CloseReopenTimeout)
+
+	waitMapsClosed(t, c)
+
+	if chunks := bc.getChunks(); len(chunks) != 1 {
+		t.Errorf("expected a single stop array, got %v", chunks)
+	}
+	if reason := c.CloseReason(); reason.Code != CloseServerClosed {
+		t.Errorf("expected server closed reason, got %v", reason)
+	}
+}
+
+func TestCloseDuringInit(t *testing.T) {
+	gcChan := make(chan SessionId, 1)
+	c := newChannel("8", SessionId{}, gcChan, "", channelSettings{})
+	c.armChannelTimeout()
+
+	c.Close()
+	c.Close()
+	waitMapsClosed(t, c)
+
+	// The stop array is delivered on the first back channel after the 'c'
+	// array, after which the channel is permanently closed.
+	bc := &fakeBackChannel{}
+	c.setBackChannel(bc)
+
+	expected := []string{`[[1,["c","` + SessionId{}.String() + `","",8]],[2,["stop",3,""]]]`}
+	if chunks := bc.getChunks(); !equalStrings(chunks, expected) {
+		t.Errorf("expected %v, got %v", expected, chunks)
+	}
+
+	select {
+	case <-gcChan:
+	default:
+		t.Error("expected channel to be terminated")
+	}
+}
+
+func TestReceiveMapsWaitExceedingCapacity(t *testing.T) {
+	c, _ := newTestChannel(channelSettings{})
+	defer c.Close()
+
+	// Maps that can never fit in the map queue are refused without waiting.
+	maps := make([]Map, defaultMapQueueCapacity+1)
+	for i := range maps {
+		maps[i] = Map{"i": strconv.Itoa(i)}
+	}
+	start := time.Now()
+	err := c.receiveMapsWait(context.Background(), nil, 0, maps, nil)
+	if err != errCapacityExceeded {
+		t.Errorf("expected %v, got %v", errCapacityExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected an immediate failure, took %s", elapsed)
+	}
+}
+
+func TestReceiveMapsWithoutReader(t *testing.T) {
+	c, _ := newTestChannel(channelSettings{})
+
+	// Fill the map channel and the pending maps without reading them.
+	for i := 0; i < 300; i++ {
+		c.receiveMaps(nil, i, []Map{{"i": strconv.Itoa(i)}}, nil)
+	}
+
+	done := make(chan bool)
+	go func() {
+		c.Close()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close blocked on the map channel")
+	}
+
+	waitMapsClosed(t, c)
+}
+
+func TestConcurrentShutdown(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		c, _ := newTestChannel(channelSettings{coalesceDelay: time.Millisecond})
+
+		var wg sync.WaitGroup
+		run := func(f func()) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				f()
+			}()
+		}
+
+		run(func() {
+			for j := 0; j < 20; j++ {
+				c.SendArray(Array{j})
+			}
+		})
+		run(func() {
+			for j := 0; j < 20; j++ {
+				c.receiveMaps(nil, j, []Map{{"j": strconv.Itoa(j)}}, nil)
+			}
+		})
+		run(func() { c.setBackChannel(&fakeBackChannel{}) })
+		run(func() { c.acknowledgeArrays(3) })
+		run(func() { c.Flush() })
+		run(func() { c.Close() })
+		run(func() { c.CloseWithReason(CloseApplication, "bye") })
+		run(func() { c.terminate(CloseClientTerminated) })
+		run(func() { c.terminate(CloseReopenTimeout) })
+
+		finished := make(chan bool)
+		go func() {
+			wg.Wait()
+			finished <- true
+		}()
+
+		select {
+		case <-finished:
+		case <-time.After(5 * time.Second):
+			t.Fatal("deadlock while shutting down the channel")
+		}
+
+		waitMapsClosed(t, c)
+
+		if c.Err() == nil {
+			t.Fatal("expected channel to have a close reason")
+		}
+	}
+}
+
+func TestReceiveBadMaps(t *testing.T) {
+	var bad []int
+	c, _ := newTestChannel(channelSettings{
+		badMapHandler: func(c *Channel, b *BadMap) {
+			bad = append(bad, b.Id)
+		},
+	})
+	defer c.terminate(CloseClientTerminated)
+
+	badMap := &BadMap{1, url.Values{"req1_type": {"_badmap"}}, errBadMapType}
+	maps := []Map{{"i": "0"}, nil, {"i": "2"}}
+
+	// The client sends the same maps again when it doesn't get a response.
+	c.receiveMaps(nil, 0, maps, []*BadMap{badMap})
+	c.receiveMaps(nil, 0, maps, []*BadMap{badMap})
+	c.receiveMaps(nil, 3, []Map{{"i": "3"}}, nil)
+
+	for _, expected := range []string{"0", "2", "3"} {
+		select {
+		case m := <-c.Maps():
+			if m["i"] != expected {
+				t.Errorf("expected map %s, got %v", expected, m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected map %s", expected)
+		}
+	}
+
+	if !equalInts(bad, []int{1}) {
+		t.Errorf("expected bad maps [1], got %v", bad)
+	}
+}
+
+func TestSendArrayAsciiOnly(t *testing.T) {
+	c, bc := newTestChannel(channelSettings{asciiOnly: true})
+	defer c.terminate(CloseClientTerminated)
+
+	c.SendArray(Array{"é😀"})
+
+	expected := []string{`[[2,["\u00e9\ud83d\ude00"]]]`}
+	if chunks := bc.getChunks(); !equalStrings(chunks, expected) {
+		t.Errorf("expected %v, got %v", expected, chunks)
+	}
+}
@@ -0,0 +1,728 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+// Package client implements a browser channel client mimicking the Closure
+// library's goog.net.BrowserChannel, for the tools and tests exercising
+// browser channel servers without a browser.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The protocol version implemented by the client.
+const ProtocolVersion = 8
+
+// The back channel types.
+const (
+	// Length prefixed chunks streamed on a XMLHttpRequest.
+	XmlHttp = "xmlhttp"
+	// Script blocks streamed in a hidden iframe, as used by IE<10.
+	Html = "html"
+)
+
+const (
+	// The default delay before the first retry of a failed request. The delay
+	// is doubled after each consecutive failure.
+	DefaultRetryDelay = 500 * time.Millisecond
+	// The default number of consecutive failures after which the session is
+	// considered lost.
+	DefaultMaxRetries = 3
+	// The maximum number of maps sent in a forward channel request.
+	maxMapsPerRequest = 1000
+	// The capacity of the channel delivering the arrays.
+	arrayChannelCapacity = 100
+)
+
+var (
+	ErrClosed     = errors.New("client closed")
+	ErrUnknownSid = errors.New("unknown session id")
+
+	errBadHandshake = errors.New("bad handshake")
+	errBadChunk     = errors.New("bad chunk")
+)
+
+// Reports that the server closed the channel with a stop array:
+// ["stop", code, message].
+type StopError struct {
+	Code    int
+	Message string
+}
+
+func (e *StopError) Error() string {
+	return fmt.Sprintf("channel stopped by the server: %d %s", e.Code, e.Message)
+}
+
+// Reports an unexpected response status.
+type StatusError struct {
+	Status int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.Status)
+}
+
+// The options of Dial.
+type Options struct {
+	// The client making the requests, http.DefaultClient when nil.
+	HTTPClient *http.Client
+	// The client version sent on the initial bind request as the CVER
+	// parameter. Not sent when empty.
+	ClientVersion string
+	// The back channel type, XmlHttp by default.
+	BackChannel string
+	// Disables the streaming of the back channels, i.e. sets CI=1, instead
+	// of relying on the test channel to detect buffering proxies.
+	NoStreaming bool
+	// Whether the host prefixes handed out by the server are used to make
+	// the test and back channel requests, e.g. on bc0.example.com instead of
+	// example.com.
+	UseHostPrefix bool
+	// The delay before the first retry of a failed request,
+	// DefaultRetryDelay when zero.
+	RetryDelay time.Duration
+	// The number of consecutive failures after which the session is
+	// considered lost, DefaultMaxRetries when zero.
+	MaxRetries int
+}
+
+// An array received from the server.
+type Array struct {
+	Id   int
+	Data json.RawMessage
+}
+
+// The counters of a client.
+type Stats struct {
+	// The number of arrays delivered.
+	Arrays int64
+	// The number of arrays received more than once, i.e. sent again by the
+	// server after a back channel was lost.
+	Duplicates int64
+	// The number of back channel requests made.
+	BackChannels int64
+	// The number of forward channel requests made, including the retries.
+	ForwardRequests int64
+	// The number of failed requests that were retried.
+	Retries int64
+}
+
+// A browser channel session.
+type Client struct {
+	opts     Options
+	endpoint *url.URL
+	chunked  bool
+
+	// Set once the session is established.
+	sid        string
+	hostPrefix string
+
+	lock        sync.Mutex
+	lastArrayId int
+	// The maps waiting to be acknowledged by the server and the id of the
+	// first of them.
+	maps      []map[string]string
+	mapOffset int
+	mapsReady chan bool
+	// Closed once the queued maps are acknowledged, see Flush.
+	flushed chan struct{}
+	rid     int
+	err     error
+
+	arrays chan *Array
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	stats struct {
+		arrays, duplicates, backChannels, forwardRequests, retries int64
+	}
+}
+
+// Opens a session with the browser channel server at the endpoint, e.g.
+// http://localhost:8080/channel, after going through the test channel
+// handshake.
+func Dial(endpoint string, opts *Options) (c *Client, err error) {
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return
+	}
+
+	c = &Client{endpoint: u, mapsReady: make(chan bool, 1), rid: rand.Intn(100000),
+		arrays: make(chan *Array, arrayChannelCapacity)}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.HTTPClient == nil {
+		c.opts.HTTPClient = http.DefaultClient
+	}
+	if len(c.opts.BackChannel) == 0 {
+		c.opts.BackChannel = XmlHttp
+	}
+	if c.opts.RetryDelay == 0 {
+		c.opts.RetryDelay = DefaultRetryDelay
+	}
+	if c.opts.MaxRetries == 0 {
+		c.opts.MaxRetries = DefaultMaxRetries
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	if err = c.test(); err != nil {
+		return nil, err
+	}
+	if err = c.bind(); err != nil {
+		return nil, err
+	}
+
+	c.wg.Add(2)
+	go c.backChannelLoop()
+	go c.forwardChannelLoop()
+	go func() {
+		c.wg.Wait()
+		close(c.arrays)
+	}()
+	return
+}
+
+// Returns the session id.
+func (c *Client) Sid() string {
+	return c.sid
+}
+
+// Returns the host prefix handed out by the server, if any.
+func (c *Client) HostPrefix() string {
+	return c.hostPrefix
+}
+
+// Returns whether the back channels are streamed.
+func (c *Client) Chunked() bool {
+	return c.chunked
+}
+
+// Returns the channel on which the arrays received from the server are
+// delivered, except the heartbeats. The channel is closed once the session
+// ends, see Err.
+func (c *Client) Arrays() <-chan *Array {
+	return c.arrays
+}
+
+// Returns why the session ended, or nil if it's still open.
+func (c *Client) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Returns the counters of the client.
+func (c *Client) Stats() Stats {
+	return Stats{
+		Arrays:          atomic.LoadInt64(&c.stats.arrays),
+		Duplicates:      atomic.LoadInt64(&c.stats.duplicates),
+		BackChannels:    atomic.LoadInt64(&c.stats.backChannels),
+		ForwardRequests: atomic.LoadInt64(&c.stats.forwardRequests),
+		Retries:         atomic.LoadInt64(&c.stats.retries),
+	}
+}
+
+// Queues a map to be sent on the forward channel. The maps are sent in order
+// and sent again until the server acknowledges them.
+func (c *Client) SendMap(m map[string]string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+	c.maps = append(c.maps, m)
+	select {
+	case c.mapsReady <- true:
+	default:
+	}
+	return nil
+}
+
+// Waits until the server acknowledged the queued maps.
+func (c *Client) Flush(ctx context.Context) error {
+	c.lock.Lock()
+	if c.err != nil || len(c.maps) == 0 {
+		c.lock.Unlock()
+		return c.Err()
+	}
+	if c.flushed == nil {
+		c.flushed = make(chan struct{})
+	}
+	flushed := c.flushed
+	c.lock.Unlock()
+
+	select {
+	case <-flushed:
+		return nil
+	case <-c.ctx.Done():
+		return c.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Terminates the session and waits for the back and forward channels to stop.
+func (c *Client) Close() error {
+	if c.fail(ErrClosed) {
+		c.terminate()
+	}
+	c.wg.Wait()
+	return nil
+}
+
+// Ends the session with the given error. Returns false if it already ended.
+func (c *Client) fail(err error) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return false
+	}
+	c.err = err
+	c.cancel()
+	return true
+}
+
+// Notifies the server that the session is terminated, as best effort.
+func (c *Client) terminate() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.RetryDelay)
+	defer cancel()
+
+	query := c.query("SID", c.sid, "RID", strconv.Itoa(c.nextRid()), "TYPE", "terminate")
+	req, _ := http.NewRequestWithContext(ctx, "GET", c.url("bind", query, false), nil)
+	if resp, err := c.opts.HTTPClient.Do(req); err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (c *Client) nextRid() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.rid++
+	return c.rid
+}
+
+// Returns the query parameters common to all requests, along with the given
+// key value pairs.
+func (c *Client) query(pairs ...string) url.Values {
+	query := url.Values{}
+	query.Set("VER", strconv.Itoa(ProtocolVersion))
+	for i := 0; i+1 < len(pairs); i += 2 {
+		query.Set(pairs[i], pairs[i+1])
+	}
+	query.Set("zx", strconv.FormatInt(rand.Int63(), 36))
+	query.Set("t", "1")
+	return query
+}
+
+// Returns the URL of a request, made on the prefixed host when prefixed is
+// true and the client uses host prefixes.
+func (c *Client) url(path string, query url.Values, prefixed bool) string {
+	u := *c.endpoint
+	u.Path += "/" + path
+	u.RawQuery = query.Encode()
+	if prefixed && c.opts.UseHostPrefix && len(c.hostPrefix) > 0 {
+		u.Host = c.hostPrefix + "." + u.Host
+	}
+	return u.String()
+}
+
+func (c *Client) do(method, url string, body string) (resp *http.Response, err error) {
+	req, err := http.NewRequestWithContext(c.ctx, method, url, strings.NewReader(body))
+	if err != nil {
+		return
+	}
+	if method == "POST" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	if resp, err = c.opts.HTTPClient.Do(req); err != nil {
+		return
+	}
+	if resp.StatusCode != 200 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode == 400 && strings.Contains(string(data), "Unknown SID") {
+			return nil, ErrUnknownSid
+		}
+		return nil, &StatusError{resp.StatusCode}
+	}
+	return
+}
+
+// Goes through the test channel handshake: fetches the host prefix and
+// checks whether the responses can be streamed.
+func (c *Client) test() (err error) {
+	resp, err := c.do("GET", c.url("test", c.query("MODE", "init"), false), "")
+	if err != nil {
+		return
+	}
+	var config []*string
+	err = json.NewDecoder(resp.Body).Decode(&config)
+	resp.Body.Close()
+	if err != nil {
+		return errBadHandshake
+	}
+	if len(config) > 0 && config[0] != nil {
+		c.hostPrefix = *config[0]
+	}
+
+	if c.opts.NoStreaming {
+		return
+	}
+
+	// The server sends 11111 and then, after a while, 2. Both are received
+	// at once when the response is buffered along the way.
+	resp, err = c.do("GET", c.url("test", c.query("TYPE", "xmlhttp"), true), "")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var received []byte
+	buf := make([]byte, 16)
+	for len(received) < 5 {
+		n, rerr := resp.Body.Read(buf)
+		received = append(received, buf[:n]...)
+		if rerr != nil {
+			break
+		}
+	}
+	if !strings.HasPrefix(string(received), "11111") {
+		return errBadHandshake
+	}
+	c.chunked = len(received) == 5
+	return
+}
+
+// Makes the initial bind request creating the session.
+func (c *Client) bind() (err error) {
+	pairs := []string{"RID", strconv.Itoa(c.nextRid())}
+	if len(c.opts.ClientVersion) > 0 {
+		pairs = append(pairs, "CVER", c.opts.ClientVersion)
+	}
+
+	resp, err := c.do("POST", c.url("bind", c.query(pairs...), false), "count=0")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	chunk, err := readChunk(bufio.NewReader(resp.Body))
+	if err != nil {
+		return
+	}
+	arrays, err := parseArrays(chunk)
+	if err != nil {
+		return
+	}
+
+	// The first array is the session configuration: ['c', sid, host
+	// prefix, version].
+	var config []interface{}
+	if len(arrays) == 0 || json.Unmarshal(arrays[0].Data, &config) != nil ||
+		len(config) < 2 || config[0] != "c" {
+		return errBadHandshake
+	}
+	if c.sid, _ = config[1].(string); len(c.sid) == 0 {
+		return errBadHandshake
+	}
+	if len(config) > 2 {
+		if prefix, ok := config[2].(string); ok && len(prefix) > 0 {
+			c.hostPrefix = prefix
+		}
+	}
+	c.lastArrayId = arrays[0].Id
+	c.deliver(arrays[1:])
+	return
+}
+
+// Waits before retrying a failed request. Returns false when the session is
+// lost or closed.
+func (c *Client) retry(failures int, err error) bool {
+	if err == ErrUnknownSid || failures > c.opts.MaxRetries {
+		c.fail(err)
+		return false
+	}
+	atomic.AddInt64(&c.stats.retries, 1)
+	select {
+	case <-time.After(c.opts.RetryDelay << uint(failures-1)):
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// Keeps a back channel open, opening a new one whenever the server ends the
+// current one.
+func (c *Client) backChannelLoop() {
+	defer c.wg.Done()
+
+	failures := 0
+	for c.ctx.Err() == nil {
+		if err := c.backChannel(); err != nil && c.ctx.Err() == nil {
+			failures++
+			if !c.retry(failures, err) {
+				return
+			}
+		} else {
+			failures = 0
+		}
+	}
+}
+
+func (c *Client) backChannel() (err error) {
+	atomic.AddInt64(&c.stats.backChannels, 1)
+
+	ci := "1"
+	if c.chunked {
+		ci = "0"
+	}
+	c.lock.Lock()
+	aid := c.lastArrayId
+	c.lock.Unlock()
+
+	query := c.query("SID", c.sid, "RID", "rpc", "AID", strconv.Itoa(aid), "CI", ci,
+		"TYPE", c.opts.BackChannel)
+	resp, err := c.do("GET", c.url("bind", query, true), "")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	r := bufio.NewReader(resp.Body)
+	for {
+		var chunk []byte
+		if c.opts.BackChannel == Html {
+			chunk, err = readHtmlChunk(r)
+		} else {
+			chunk, err = readChunk(r)
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return
+		} else if chunk == nil {
+			continue
+		}
+
+		arrays, err := parseArrays(chunk)
+		if err != nil {
+			return err
+		}
+		c.deliver(arrays)
+	}
+}
+
+// Delivers the arrays that weren't received yet. Heartbeats aren't delivered
+// and a stop array ends the session.
+func (c *Client) deliver(arrays []*Array) {
+	for _, a := range arrays {
+		c.lock.Lock()
+		if a.Id <= c.lastArrayId {
+			c.lock.Unlock()
+			atomic.AddInt64(&c.stats.duplicates, 1)
+			continue
+		}
+		c.lastArrayId = a.Id
+		c.lock.Unlock()
+
+		var values []interface{}
+		json.Unmarshal(a.Data, &values)
+		if len(values) > 0 {
+			switch values[0] {
+			case "noop":
+				continue
+			case "stop":
+				stop := &StopError{}
+				if len(values) > 1 {
+					code, _ := values[1].(float64)
+					stop.Code = int(code)
+				}
+				if len(values) > 2 {
+					stop.Message, _ = values[2].(string)
+				}
+				c.fail(stop)
+				return
+			}
+		}
+
+		select {
+		case c.arrays <- a:
+			atomic.AddInt64(&c.stats.arrays, 1)
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// Sends the queued maps, one request at a time.
+func (c *Client) forwardChannelLoop() {
+	defer c.wg.Done()
+
+	failures := 0
+	for {
+		c.lock.Lock()
+		maps := c.maps
+		if len(maps) > maxMapsPerRequest {
+			maps = maps[:maxMapsPerRequest]
+		}
+		offset := c.mapOffset
+		c.lock.Unlock()
+
+		if len(maps) == 0 {
+			select {
+			case <-c.mapsReady:
+				continue
+			case <-c.ctx.Done():
+				return
+			}
+		}
+
+		if err := c.forwardChannel(offset, maps); err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+			failures++
+			if !c.retry(failures, err) {
+				return
+			}
+			continue
+		}
+
+		failures = 0
+		c.lock.Lock()
+		c.maps = c.maps[len(maps):]
+		c.mapOffset += len(maps)
+		if len(c.maps) == 0 && c.flushed != nil {
+			close(c.flushed)
+			c.flushed = nil
+		}
+		c.lock.Unlock()
+	}
+}
+
+func (c *Client) forwardChannel(offset int, maps []map[string]string) (err error) {
+	atomic.AddInt64(&c.stats.forwardRequests, 1)
+
+	c.lock.Lock()
+	aid := c.lastArrayId
+	c.lock.Unlock()
+
+	body := url.Values{}
+	body.Set("count", strconv.Itoa(len(maps)))
+	body.Set("ofs", strconv.Itoa(offset))
+	for i, m := range maps {
+		for k, v := range m {
+			body.Set("req"+strconv.Itoa(i)+"_"+k, v)
+		}
+	}
+
+	query := c.query("SID", c.sid, "RID", strconv.Itoa(c.nextRid()), "AID", strconv.Itoa(aid))
+	resp, err := c.do("POST", c.url("bind", query, false), body.Encode())
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	_, err = readChunk(bufio.NewReader(resp.Body))
+	return
+}
+
+// Parses the arrays of a chunk: [[id, array], ...].
+func parseArrays(chunk []byte) (arrays []*Array, err error) {
+	var raw [][]json.RawMessage
+	if err = json.Unmarshal(chunk, &raw); err != nil {
+		return
+	}
+	for _, pair := range raw {
+		if len(pair) != 2 {
+			return nil, errBadChunk
+		}
+		a := &Array{Data: pair[1]}
+		if err = json.Unmarshal(pair[0], &a.Id); err != nil {
+			return nil, errBadChunk
+		}
+		arrays = append(arrays, a)
+	}
+	return
+}
+
+// Reads a length prefixed chunk. The length is expressed in UTF-16 code
+// units, as measured by the JavaScript clients.
+func readChunk(r *bufio.Reader) (chunk []byte, err error) {
+	line, err := r.ReadString('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || length < 0 {
+		return nil, errBadChunk
+	}
+
+	for units := 0; units < length; {
+		ch, size, rerr := r.ReadRune()
+		if rerr == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if rerr != nil {
+			return nil, rerr
+		}
+		chunk = append(chunk, string(ch)...)
+		if size == 4 {
+			units += 2
+		} else {
+			units++
+		}
+	}
+	return
+}
+
+// Reads a script block of a HTML back channel. Returns the data passed to the
+// parent.m function, nil for the other blocks, or io.EOF once the parent.d
+// function is called.
+func readHtmlChunk(r *bufio.Reader) (chunk []byte, err error) {
+	var block strings.Builder
+	for !strings.HasSuffix(block.String(), "</script>") {
+		s, rerr := r.ReadString('>')
+		block.WriteString(s)
+		if rerr == io.EOF && strings.TrimSpace(block.String()) == "" {
+			return nil, io.EOF
+		} else if rerr == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if rerr != nil {
+			return nil, rerr
+		}
+	}
+
+	s := block.String()
+	if strings.Contains(s, "parent.d()") {
+		return nil, io.EOF
+	}
+	const rpc = "parent.m('"
+	start := strings.Index(s, rpc)
+	if start < 0 {
+		return nil, nil
+	}
+	end := strings.LastIndex(s, "')")
+	if end < start+len(rpc) {
+		return nil, errBadChunk
+	}
+	return []byte(s[start+len(rpc) : end]), nil
+}
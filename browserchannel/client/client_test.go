@@ -0,0 +1,256 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	bc "github.com/MathieuTurcotte/go-browserchannel/browserchannel"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Starts a server echoing the text of the maps received on its channels.
+func startEchoServer(closed chan<- error) *httptest.Server {
+	h := bc.NewHandler(func(c *bc.Channel) {
+		for m := range c.Maps() {
+			c.SendArray(bc.Array{m["text"]})
+		}
+		if closed != nil {
+			closed <- c.Err()
+		}
+	})
+	return httptest.NewServer(h)
+}
+
+// Reads the next array, expected to be a single string.
+func readString(t *testing.T, c *Client) string {
+	select {
+	case a, ok := <-c.Arrays():
+		if !ok {
+			t.Fatalf("arrays closed: %v", c.Err())
+		}
+		var values []string
+		if err := json.Unmarshal(a.Data, &values); err != nil || len(values) != 1 {
+			t.Fatalf("unexpected array %s", a.Data)
+		}
+		return values[0]
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an array")
+	}
+	return ""
+}
+
+func TestClient(t *testing.T) {
+	cases := []struct {
+		name string
+		opts Options
+	}{
+		{"xmlhttp", Options{}},
+		{"html", Options{BackChannel: Html}},
+		{"xmlhttp not chunked", Options{NoStreaming: true}},
+		{"html not chunked", Options{BackChannel: Html, NoStreaming: true}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			closed := make(chan error, 1)
+			server := startEchoServer(closed)
+			defer server.Close()
+
+			client, err := Dial(server.URL+"/channel", &c.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if client.Chunked() == c.opts.NoStreaming {
+				t.Errorf("expected chunked %v", !c.opts.NoStreaming)
+			}
+
+			texts := []string{"a", "b c", "é😀"}
+			for _, text := range texts {
+				client.SendMap(map[string]string{"text": text})
+			}
+			if err := client.Flush(context.Background()); err != nil {
+				t.Errorf("expected maps to be flushed, got %v", err)
+			}
+			for _, expected := range texts {
+				if text := readString(t, client); text != expected {
+					t.Errorf("expected %q, got %q", expected, text)
+				}
+			}
+
+			client.Close()
+			if _, ok := <-client.Arrays(); ok {
+				t.Error("expected arrays to be closed")
+			}
+			if err := client.Err(); err != ErrClosed {
+				t.Errorf("expected %v, got %v", ErrClosed, err)
+			}
+
+			select {
+			case err := <-closed:
+				if reason, ok := err.(*bc.CloseReason); !ok || reason.Code != bc.CloseClientTerminated {
+					t.Errorf("expected client terminated reason, got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("expected the server channel to be closed")
+			}
+		})
+	}
+}
+
+func TestClientRecyclesBackChannels(t *testing.T) {
+	server := startEchoServer(nil)
+	defer server.Close()
+
+	client, err := Dial(server.URL+"/channel", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	payload := strings.Repeat("x", 1024)
+	for i := 0; i < 50; i++ {
+		expected := strconv.Itoa(i) + payload
+		client.SendMap(map[string]string{"text": expected})
+		if text := readString(t, client); text != expected {
+			t.Fatalf("expected array %d, got %.10q", i, text)
+		}
+	}
+
+	// The server ends the back channels once they carried 10KB.
+	if stats := client.Stats(); stats.BackChannels < 5 || stats.Arrays != 50 {
+		t.Errorf("expected 50 arrays over at least 5 back channels, got %+v", stats)
+	}
+}
+
+func TestClientHostPrefix(t *testing.T) {
+	var lock sync.Mutex
+	hosts := make(map[string]bool)
+
+	h := bc.NewHandler(func(c *bc.Channel) {
+		for m := range c.Maps() {
+			c.SendArray(bc.Array{m["text"]})
+		}
+	})
+	h.SetCrossDomainPrefix("example.com", []string{"bc0"})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		hosts[req.URL.Path+" "+req.Host] = true
+		lock.Unlock()
+		h.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+
+	// Every host resolves to the test server.
+	transport := &http.Transport{DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+	}}
+	defer transport.CloseIdleConnections()
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	client, err := Dial("http://example.com:"+port+"/channel", &Options{
+		HTTPClient:    &http.Client{Transport: transport},
+		UseHostPrefix: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.SendMap(map[string]string{"text": "a"})
+	if text := readString(t, client); text != "a" {
+		t.Errorf("expected %q, got %q", "a", text)
+	}
+	if prefix := client.HostPrefix(); prefix != "bc0" {
+		t.Errorf("expected host prefix bc0, got %q", prefix)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for path, prefixed := range map[string]bool{"/channel/test": true, "/channel/bind": true} {
+		host := "example.com:" + port
+		if prefixed {
+			host = "bc0." + host
+		}
+		if !hosts[path+" "+host] {
+			t.Errorf("expected a request to %s on %s, got %v", path, host, hosts)
+		}
+	}
+	if !hosts["/channel/bind example.com:"+port] {
+		t.Errorf("expected the forward channel on example.com, got %v", hosts)
+	}
+}
+
+func TestClientStop(t *testing.T) {
+	server := httptest.NewServer(bc.NewHandler(func(c *bc.Channel) {
+		<-c.Maps()
+		c.CloseWithReason(bc.CloseApplication, "bye")
+	}))
+	defer server.Close()
+
+	client, err := Dial(server.URL+"/channel", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SendMap(map[string]string{"a": "1"})
+
+	select {
+	case _, ok := <-client.Arrays():
+		if ok {
+			t.Fatal("expected arrays to be closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the stop array")
+	}
+
+	expected := StopError{int(bc.CloseApplication), "bye"}
+	if err, ok := client.Err().(*StopError); !ok || *err != expected {
+		t.Errorf("expected %v, got %v", &expected, client.Err())
+	}
+	if err := client.SendMap(map[string]string{}); err != client.Err() {
+		t.Errorf("expected %v, got %v", client.Err(), err)
+	}
+}
+
+func TestReadChunk(t *testing.T) {
+	cases := []struct {
+		data     string
+		expected []string
+		err      bool
+	}{
+		{"3\nabc2\nde", []string{"abc", "de"}, false},
+		// The lengths are in UTF-16 code units.
+		{"3\né😀5\n[1,2]", []string{"é😀", "[1,2]"}, false},
+		{"4\nabc", nil, true},
+		{"x\nabc", nil, true},
+	}
+
+	for _, c := range cases {
+		r := bufio.NewReader(strings.NewReader(c.data))
+		var chunks []string
+		var err error
+		for {
+			var chunk []byte
+			if chunk, err = readChunk(r); err != nil {
+				break
+			}
+			chunks = append(chunks, string(chunk))
+		}
+		if c.err == (err == io.EOF) {
+			t.Errorf("%q: unexpected error %v", c.data, err)
+		}
+		if !c.err && strings.Join(chunks, "|") != strings.Join(c.expected, "|") {
+			t.Errorf("%q: expected %q, got %q", c.data, c.expected, chunks)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"context"
+	"fmt"
+)
+
+// Identifies why a channel was closed. Applications may define their own codes
+// for CloseWithReason starting at CloseApplication.
+type CloseCode int
+
+const (
+	// The client terminated the channel.
+	CloseClientTerminated CloseCode = iota + 1
+	// The client didn't reopen a back channel before the reopen timeout.
+	CloseReopenTimeout
+	// The channel was closed by the application.
+	CloseServerClosed
+	// The handler was shut down.
+	CloseHandlerShutdown
+	// The client didn't respect the protocol.
+	CloseProtocolError
+	// The client version isn't supported, see VersionRouter.
+	CloseUnsupportedVersion
+	// The first code available to applications.
+	CloseApplication CloseCode = 1000
+)
+
+func (code CloseCode) String() string {
+	switch code {
+	case CloseClientTerminated:
+		return "client terminated"
+	case CloseReopenTimeout:
+		return "reopen timeout"
+	case CloseServerClosed:
+		return "server closed"
+	case CloseHandlerShutdown:
+		return "handler shutdown"
+	case CloseProtocolError:
+		return "protocol error"
+	case CloseUnsupportedVersion:
+		return "unsupported version"
+	}
+	return fmt.Sprintf("close code %d", int(code))
+}
+
+// Describes why a channel was closed.
+type CloseReason struct {
+	Code    CloseCode
+	Message string
+}
+
+func (r *CloseReason) Error() string {
+	if len(r.Message) > 0 {
+		return "channel closed: " + r.Code.String() + ": " + r.Message
+	}
+	return "channel closed: " + r.Code.String()
+}
+
+// Records the close reason unless the channel was already closed.
+func (c *Channel) setCloseReason(code CloseCode, message string) {
+	if c.closeReason == nil {
+		c.closeReason = &CloseReason{code, message}
+	}
+}
+
+// Returns why the channel was closed or nil if the channel is still open.
+func (c *Channel) CloseReason() *CloseReason {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.closeReason
+}
+
+// Returns a context that is cancelled when the channel is closed for any
+// reason. The cause of the cancellation, see context.Cause, is the channel's
+// *CloseReason. Intended to tie the lifetime of goroutines serving a channel
+// to the channel itself.
+func (c *Channel) Context() context.Context {
+	return c.ctx
+}
+
+// Returns a *CloseReason error once the channel is closed and nil otherwise.
+func (c *Channel) Err() error {
+	if reason := c.CloseReason(); reason != nil {
+		return reason
+	}
+	return nil
+}
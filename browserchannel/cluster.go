@@ -0,0 +1,87 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// Header set on the requests forwarded to another node. Forwarded requests are
+// always served locally to avoid forwarding loops.
+const forwardedHeader = "X-Browserchannel-Forwarded"
+
+// An http.Handler forwarding the browser channel requests of the sessions
+// owned by other nodes of a cluster, as identified by the node id of their
+// signed session id or by the host prefix of the request. The other requests
+// are served by the local handler.
+//
+// The nodes of a cluster must share the keys of their SessionIdSigner and
+// their host prefix mapping. See Handler.SetHostPrefixNodes.
+type Forwarder struct {
+	local       http.Handler
+	signer      *SessionIdSigner
+	proxies     map[string]*httputil.ReverseProxy
+	prefixNodes map[string]string
+}
+
+// Creates a forwarder serving the requests owned by the signer's node with the
+// local handler and reverse proxying the others to the node URLs, keyed by
+// node id. Without a signer, the node doesn't belong to a cluster and every
+// request is served by the local handler.
+func NewForwarder(local http.Handler, signer *SessionIdSigner, nodes map[string]*url.URL) *Forwarder {
+	proxies := make(map[string]*httputil.ReverseProxy)
+	for node, target := range nodes {
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		// Stream the back channel chunks as soon as they are received.
+		proxy.FlushInterval = -1
+		proxies[node] = proxy
+	}
+	return &Forwarder{local: local, signer: signer, proxies: proxies}
+}
+
+// Maps host prefixes to node ids. Should match the mapping given to the
+// handlers of the cluster.
+func (f *Forwarder) SetHostPrefixNodes(nodes map[string]string) {
+	f.prefixNodes = nodes
+}
+
+// Returns the node owning the request, or an empty string if it doesn't
+// belong to a specific node. Session ids that aren't properly signed are left
+// to the local handler, which rejects them.
+func (f *Forwarder) owner(req *http.Request) string {
+	if sid := req.URL.Query().Get("SID"); len(sid) > 0 {
+		_, node, _, err := f.signer.parse(sid)
+		if err == errForeignSessionId {
+			return node
+		}
+		return ""
+	}
+
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if i := strings.Index(host, "."); i > 0 {
+		return f.prefixNodes[host[:i]]
+	}
+	return ""
+}
+
+func (f *Forwarder) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if f.signer != nil && len(req.Header.Get(forwardedHeader)) == 0 {
+		node := f.owner(req)
+		if proxy, ok := f.proxies[node]; ok && node != f.signer.NodeId() {
+			log.Printf("forwarding %s to node %s\n", req.URL.Path, node)
+			req.Header.Set(forwardedHeader, f.signer.NodeId())
+			proxy.ServeHTTP(rw, req)
+			return
+		}
+	}
+	f.local.ServeHTTP(rw, req)
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestForwarder(t *testing.T) {
+	key := []byte("key")
+	signerA, _ := NewSessionIdSigner("a", key)
+	signerB, _ := NewSessionIdSigner("b", key)
+	sid, _ := generateSesionId(rand.Reader)
+
+	remote := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "b")
+	}))
+	defer remote.Close()
+
+	target, _ := url.Parse(remote.URL)
+	local := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "a")
+	})
+
+	forwarder := NewForwarder(local, signerA, map[string]*url.URL{"b": target})
+	forwarder.SetHostPrefixNodes(map[string]string{"bc0": "a", "bc1": "b"})
+
+	cases := []struct {
+		host      string
+		sid       string
+		forwarded bool
+		expected  string
+	}{
+		{"example.com", "", false, "a"},
+		{"example.com", signerA.sign(sid, time.Now()), false, "a"},
+		{"example.com", signerB.sign(sid, time.Now()), false, "b"},
+		{"example.com", signerB.sign(sid, time.Now()), true, "a"},
+		{"example.com", sid.String(), false, "a"},
+		{"bc0.example.com:8080", "", false, "a"},
+		{"bc1.example.com:8080", "", false, "b"},
+		{"bc1.example.com", "", true, "a"},
+		{"bc2.example.com", "", false, "a"},
+	}
+
+	for i, c := range cases {
+		req := httptest.NewRequest("GET", "/channel/bind?SID="+url.QueryEscape(c.sid), nil)
+		req.Host = c.host
+		if c.forwarded {
+			req.Header.Set(forwardedHeader, "b")
+		}
+		rw := httptest.NewRecorder()
+		forwarder.ServeHTTP(rw, req)
+		if body := rw.Body.String(); body != c.expected {
+			t.Errorf("case %d: expected node %s, got %q", i, c.expected, body)
+		}
+	}
+}
+
+func TestForwarderWithoutSigner(t *testing.T) {
+	signer, _ := NewSessionIdSigner("b", []byte("key"))
+	sid, _ := generateSesionId(rand.Reader)
+
+	local := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "a")
+	})
+	target, _ := url.Parse("http://127.0.0.1:1")
+	forwarder := NewForwarder(local, nil, map[string]*url.URL{"b": target})
+	forwarder.SetHostPrefixNodes(map[string]string{"bc1": "b"})
+
+	for _, host := range []string{"example.com", "bc1.example.com"} {
+		req := httptest.NewRequest("GET", "/channel/bind?SID="+url.QueryEscape(signer.sign(sid, time.Now())), nil)
+		req.Host = host
+		rw := httptest.NewRecorder()
+		forwarder.ServeHTTP(rw, req)
+		if body := rw.Body.String(); body != "a" {
+			t.Errorf("%s: expected the local handler, got %q", host, body)
+		}
+	}
+}
+
+func TestHostPrefixNodes(t *testing.T) {
+	signer, _ := NewSessionIdSigner("a", []byte("key"))
+
+	h := NewHandler(func(*Channel) {})
+	h.SetCrossDomainPrefix("example.com", []string{"bc0", "bc1", "bc2"})
+
+	if prefix := h.hostPrefix(); prefix != "bc0" && prefix != "bc1" && prefix != "bc2" {
+		t.Errorf("expected a cross domain prefix, got %q", prefix)
+	}
+
+	h.SetSessionIdSigner(signer)
+	h.SetHostPrefixNodes(map[string]string{"bc0": "b", "bc1": "a", "bc2": "b"})
+
+	for i := 0; i < 10; i++ {
+		if prefix := h.hostPrefix(); prefix != "bc1" {
+			t.Fatalf("expected the prefix of node a, got %q", prefix)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Checks whether the client accepts gzip encoded responses.
+func acceptsGzip(req *http.Request) bool {
+	for _, value := range req.Header["Accept-Encoding"] {
+		for _, coding := range strings.Split(value, ",") {
+			parts := strings.Split(coding, ";")
+			if strings.TrimSpace(parts[0]) != "gzip" {
+				continue
+			}
+			// A zero quality value means that gzip isn't acceptable.
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(param[2:], 64)
+					return err == nil && q > 0
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Writes the back channel chunks to the response, compressing them when
+// compress is set. The encoding is chosen when the request arrives so the
+// response header can be sent right away, before any chunk is available. Each
+// chunk is flushed through the compressor so the client receives it
+// immediately.
+type chunkWriter struct {
+	rw       http.ResponseWriter
+	compress bool
+	gz       *gzip.Writer
+	started  bool
+	// The recorder of the response, which records the chunks before they
+	// are compressed. Nil when the response isn't recorded.
+	recording *recordingResponseWriter
+}
+
+func newChunkWriter(rw http.ResponseWriter, compress bool) *chunkWriter {
+	recording, _ := rw.(*recordingResponseWriter)
+	return &chunkWriter{rw: rw, compress: compress, recording: recording}
+}
+
+// Writes and flushes the response header so the client and the
+// intermediaries see the response start even if no chunk is sent for a while.
+func (w *chunkWriter) start() {
+	if !w.started {
+		w.writeHeader()
+	}
+}
+
+// Bounds the time allowed for the next write so writes to a client that stopped
+// reading eventually fail. Ignored by response writers without deadlines.
+func (w *chunkWriter) setWriteDeadline() {
+	http.NewResponseController(w.rw).SetWriteDeadline(time.Now().Add(backChannelWriteTimeout))
+}
+
+func (w *chunkWriter) writeHeader() {
+	w.setWriteDeadline()
+	if w.compress {
+		w.rw.Header().Set("Content-Encoding", "gzip")
+		w.rw.Header().Add("Vary", "Accept-Encoding")
+		w.gz = gzip.NewWriter(w.rw)
+	}
+	w.rw.WriteHeader(200)
+	flush(w.rw)
+	w.started = true
+}
+
+func (w *chunkWriter) writeChunk(chunk []byte) (err error) {
+	w.start()
+	w.setWriteDeadline()
+	if w.gz != nil {
+		if w.recording != nil {
+			w.recording.recordUncompressed(chunk)
+		}
+		if _, err = w.gz.Write(chunk); err == nil {
+			err = w.gz.Flush()
+		}
+	} else {
+		_, err = w.rw.Write(chunk)
+	}
+
+	if ferr := flush(w.rw); err == nil && ferr != http.ErrNotSupported {
+		err = ferr
+	}
+	return
+}
+
+// Writes the response header if it wasn't written and terminates the
+// compressed stream.
+func (w *chunkWriter) close() (err error) {
+	w.start()
+	// The deadline also applies to the end of the response, written once
+	// the handler returns.
+	w.setWriteDeadline()
+	if w.gz != nil {
+		err = w.gz.Close()
+	}
+	return
+}
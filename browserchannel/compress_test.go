@@ -0,0 +1,113 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	cases := []struct {
+		header   string
+		expected bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip", true},
+		{"gzip;q=0.5, deflate", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.000", false},
+		{"identity", false},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "/channel/bind", nil)
+		req.Header.Set("Accept-Encoding", c.header)
+		if actual := acceptsGzip(req); actual != c.expected {
+			t.Errorf("expected %t, got %t for %q", c.expected, actual, c.header)
+		}
+	}
+}
+
+func TestChunkWriterCompressed(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := newChunkWriter(rec, true)
+	w.start()
+
+	if !rec.Flushed || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("expected the gzip encoded response header to be flushed immediately")
+	}
+
+	chunks := []string{"first chunk", "a", "last chunk"}
+	for i, chunk := range chunks {
+		w.writeChunk([]byte(chunk))
+		if i == 0 && rec.Body.Len() == 0 {
+			t.Fatal("expected first chunk to be flushed")
+		}
+	}
+	w.close()
+
+	r, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "first chunkalast chunk" {
+		t.Errorf("unexpected decompressed body %q", body)
+	}
+}
+
+func TestChunkWriterUncompressed(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := newChunkWriter(rec, false)
+	w.start()
+
+	if !rec.Flushed {
+		t.Fatal("expected header to be flushed immediately")
+	}
+
+	w.close()
+
+	if rec.Code != 200 || rec.Body.Len() != 0 {
+		t.Errorf("unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandlerStartsCompressedBackChannel(t *testing.T) {
+	h := NewHandler(func(c *Channel) {})
+	h.SetCompression(true)
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	client := server.Client()
+	base := server.URL + "/channel/"
+	match := sidArrayRegexp.FindStringSubmatch(get(t, client, base+"bind?VER=8&RID=1&zx=b&t=1", "count=0"))
+	if match == nil {
+		t.Fatal("expected the 'c' array")
+	}
+
+	// The response header of an idle back channel has to be received
+	// without waiting for a chunk.
+	req, _ := http.NewRequest("GET", base+"bind?VER=8&SID="+match[1]+"&RID=rpc&AID=1&CI=0&TYPE=xmlhttp&zx=c&t=1", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := client.Transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("unexpected response %d %v", resp.StatusCode, resp.Header)
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+// Package faultproxy implements a proxy injecting faults in the requests made
+// to a browser channel handler, to exercise the recovery logic of the
+// protocol: arrays sent again on a new back channel, maps received twice,
+// requests retried by the client.
+package faultproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The requests a rule applies to.
+type Target string
+
+const (
+	AnyRequest Target = "any"
+	// The test channel requests.
+	TestRequest Target = "test"
+	// The bind requests creating a session.
+	CreateRequest Target = "create"
+	// The bind requests carrying maps.
+	ForwardChannel Target = "forward"
+	// The bind requests carrying arrays.
+	BackChannel Target = "back"
+	// The bind requests terminating a session.
+	TerminateRequest Target = "terminate"
+)
+
+// The fault injected by a rule.
+type Action string
+
+const (
+	// Drops a chunk of the response and aborts the connection.
+	Drop Action = "drop"
+	// Forwards the first bytes of a chunk of the response and aborts the
+	// connection.
+	Truncate Action = "truncate"
+	// Delays the request before forwarding it.
+	Delay Action = "delay"
+	// Forwards the request twice, the response of the first one being
+	// discarded. The first request has to complete, e.g. a forward channel
+	// request.
+	Duplicate Action = "duplicate"
+	// Responds with an error status.
+	Fail Action = "fail"
+	// Holds the connection open without forwarding the request and aborts it.
+	Hold Action = "hold"
+)
+
+var (
+	errBadRule       = errors.New("bad rule")
+	errFaultInjected = errors.New("fault injected")
+)
+
+// A fault injection rule.
+type Rule struct {
+	Target Target
+	Action Action
+	// The number of matching requests let through before the rule applies.
+	Skip int
+	// The number of requests the rule applies to, unlimited when zero.
+	Times int
+	// The index of the chunk dropped or truncated. The chunks are the data
+	// flushed by the handler, e.g. the arrays of a back channel.
+	Chunk int
+	// The number of bytes of the chunk kept by Truncate.
+	Bytes int
+	// The status returned by Fail, http.StatusServiceUnavailable when zero.
+	Status int
+	// Whether Fail forwards the request and discards its response, so the
+	// server processes a request the client believes failed. The request has
+	// to complete, e.g. a forward channel request.
+	Forward bool
+	// The delay of Delay and the time Hold holds the connection, which is
+	// until the client gives up when zero.
+	Delay time.Duration
+}
+
+func (r Rule) String() string {
+	s := string(r.Target) + " " + string(r.Action)
+	if r.Chunk != 0 {
+		s += " chunk=" + strconv.Itoa(r.Chunk)
+	}
+	if r.Bytes != 0 {
+		s += " bytes=" + strconv.Itoa(r.Bytes)
+	}
+	if r.Status != 0 {
+		s += " status=" + strconv.Itoa(r.Status)
+	}
+	if r.Forward {
+		s += " forward"
+	}
+	if r.Delay != 0 {
+		s += " delay=" + r.Delay.String()
+	}
+	if r.Skip != 0 {
+		s += " skip=" + strconv.Itoa(r.Skip)
+	}
+	if r.Times != 0 {
+		s += " times=" + strconv.Itoa(r.Times)
+	}
+	return s
+}
+
+// Parses a rule of the form "target action [option...]", e.g. "back drop
+// chunk=1 times=2" or "forward fail status=502 forward". The options are the
+// fields of Rule in lower case, Forward being set by "forward".
+func ParseRule(s string) (r Rule, err error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return r, errBadRule
+	}
+
+	r.Target = Target(fields[0])
+	switch r.Target {
+	case AnyRequest, TestRequest, CreateRequest, ForwardChannel, BackChannel, TerminateRequest:
+	default:
+		return r, fmt.Errorf("unknown target %q", fields[0])
+	}
+
+	r.Action = Action(fields[1])
+	switch r.Action {
+	case Drop, Truncate, Delay, Duplicate, Fail, Hold:
+	default:
+		return r, fmt.Errorf("unknown action %q", fields[1])
+	}
+
+	for _, option := range fields[2:] {
+		if option == "forward" {
+			r.Forward = true
+			continue
+		}
+		key, value, _ := strings.Cut(option, "=")
+		if key == "delay" {
+			if r.Delay, err = time.ParseDuration(value); err != nil {
+				return
+			}
+			continue
+		}
+
+		var n int
+		if n, err = strconv.Atoi(value); err != nil || n < 0 {
+			return r, fmt.Errorf("bad option %q", option)
+		}
+		switch key {
+		case "skip":
+			r.Skip = n
+		case "times":
+			r.Times = n
+		case "chunk":
+			r.Chunk = n
+		case "bytes":
+			r.Bytes = n
+		case "status":
+			r.Status = n
+		default:
+			return r, fmt.Errorf("unknown option %q", option)
+		}
+	}
+	return
+}
+
+// Returns the target of a request.
+func classify(req *http.Request) Target {
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	switch {
+	case strings.HasSuffix(path, "/test"):
+		return TestRequest
+	case !strings.HasSuffix(path, "/bind"):
+		return AnyRequest
+	case req.URL.Query().Get("TYPE") == "terminate":
+		return TerminateRequest
+	case req.Method == "GET":
+		return BackChannel
+	case len(req.URL.Query().Get("SID")) > 0:
+		return ForwardChannel
+	}
+	return CreateRequest
+}
+
+type ruleState struct {
+	Rule
+	matched int
+	applied int
+}
+
+// Forwards the requests to a handler, injecting faults according to its
+// rules. A request is subject to the first rule matching it. The
+// Accept-Encoding header is removed so the chunks are the uncompressed
+// responses of the handler. WebSocket connections are forwarded untouched.
+type Proxy struct {
+	handler http.Handler
+	lock    sync.Mutex
+	rules   []*ruleState
+}
+
+// Creates a proxy in front of the given handler, e.g. a browser channel
+// handler or a reverse proxy to a browser channel server.
+func New(handler http.Handler, rules ...Rule) *Proxy {
+	p := &Proxy{handler: handler}
+	for _, r := range rules {
+		p.AddRule(r)
+	}
+	return p
+}
+
+// Adds a rule, applying after the existing ones.
+func (p *Proxy) AddRule(r Rule) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.rules = append(p.rules, &ruleState{Rule: r})
+}
+
+// Returns the number of requests each rule applied to, in the order the rules
+// were added.
+func (p *Proxy) Applied() []int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	applied := make([]int, len(p.rules))
+	for i, r := range p.rules {
+		applied[i] = r.applied
+	}
+	return applied
+}
+
+// Returns the rule applying to a request, if any.
+func (p *Proxy) match(target Target) *Rule {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, r := range p.rules {
+		if r.Target != AnyRequest && r.Target != target {
+			continue
+		}
+		if r.Times > 0 && r.applied >= r.Times {
+			continue
+		}
+		r.matched++
+		if r.matched <= r.Skip {
+			continue
+		}
+		r.applied++
+		rule := r.Rule
+		return &rule
+	}
+	return nil
+}
+
+func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		p.handler.ServeHTTP(rw, req)
+		return
+	}
+	req.Header.Del("Accept-Encoding")
+
+	target := classify(req)
+	rule := p.match(target)
+	if rule == nil {
+		p.handler.ServeHTTP(rw, req)
+		return
+	}
+	log.Printf("faultproxy: %s %s: %s\n", req.Method, req.URL, rule)
+
+	switch rule.Action {
+	case Drop, Truncate:
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		w := &faultyResponseWriter{ResponseWriter: rw, rule: rule, cancel: cancel}
+		p.handler.ServeHTTP(w, req.WithContext(ctx))
+		w.end()
+	case Delay:
+		select {
+		case <-time.After(rule.Delay):
+			p.handler.ServeHTTP(rw, req)
+		case <-req.Context().Done():
+		}
+	case Duplicate:
+		body, _ := io.ReadAll(req.Body)
+		p.discard(req, body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		p.handler.ServeHTTP(rw, req)
+	case Fail:
+		if rule.Forward {
+			body, _ := io.ReadAll(req.Body)
+			p.discard(req, body)
+		}
+		status := rule.Status
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(rw, http.StatusText(status), status)
+	case Hold:
+		var timeout <-chan time.Time
+		if rule.Delay > 0 {
+			timeout = time.After(rule.Delay)
+		}
+		select {
+		case <-timeout:
+		case <-req.Context().Done():
+		}
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// Forwards a copy of the request and discards its response.
+func (p *Proxy) discard(req *http.Request, body []byte) {
+	r := req.Clone(req.Context())
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	p.handler.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+// Drops or truncates a chunk of the response. Once the fault is injected, the
+// request is cancelled and the writes fail so the handler gives up on the
+// response, which is then aborted.
+type faultyResponseWriter struct {
+	http.ResponseWriter
+	rule   *Rule
+	cancel context.CancelFunc
+	chunks int
+	data   bytes.Buffer
+	broken bool
+}
+
+func (w *faultyResponseWriter) Write(data []byte) (int, error) {
+	if w.broken {
+		return 0, errFaultInjected
+	}
+	return w.data.Write(data)
+}
+
+func (w *faultyResponseWriter) FlushError() error {
+	if w.broken {
+		return errFaultInjected
+	}
+	if w.data.Len() > 0 {
+		chunk := w.data.Bytes()
+		if w.chunks == w.rule.Chunk {
+			w.broken = true
+			w.cancel()
+			if w.rule.Action == Truncate && w.rule.Bytes < len(chunk) {
+				chunk = chunk[:w.rule.Bytes]
+			} else if w.rule.Action == Drop {
+				chunk = nil
+			}
+		}
+		w.chunks++
+		w.data.Reset()
+		if _, err := w.ResponseWriter.Write(chunk); err != nil {
+			return err
+		}
+	}
+	if err := http.NewResponseController(w.ResponseWriter).Flush(); err != nil {
+		return err
+	}
+	if w.broken {
+		return errFaultInjected
+	}
+	return nil
+}
+
+func (w *faultyResponseWriter) Flush() {
+	w.FlushError()
+}
+
+// Writes the data that wasn't flushed by the handler as the last chunk and
+// aborts the response if the fault was injected.
+func (w *faultyResponseWriter) end() {
+	w.FlushError()
+	if w.broken {
+		panic(http.ErrAbortHandler)
+	}
+}
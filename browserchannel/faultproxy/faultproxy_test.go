@@ -0,0 +1,240 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package faultproxy
+
+import (
+	"context"
+	"encoding/json"
+	bc "github.com/MathieuTurcotte/go-browserchannel/browserchannel"
+	"github.com/MathieuTurcotte/go-browserchannel/browserchannel/client"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The maps sent by the client, in batches.
+const (
+	batches   = 4
+	batchSize = 5
+)
+
+// A server echoing the maps received on its channels and recording them.
+type echoServer struct {
+	lock   sync.Mutex
+	maps   []string
+	closed chan bool
+}
+
+func (s *echoServer) handleChannel(c *bc.Channel) {
+	for m := range c.Maps() {
+		s.lock.Lock()
+		s.maps = append(s.maps, m["i"])
+		s.lock.Unlock()
+		c.SendArray(bc.Array{m["i"]})
+	}
+	s.closed <- true
+}
+
+func (s *echoServer) getMaps() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.maps...)
+}
+
+func expectedValues() (values []string) {
+	for i := 0; i < batches*batchSize; i++ {
+		values = append(values, strconv.Itoa(i))
+	}
+	return
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Reads the arrays until the expected number is received, and a little while
+// longer to catch the extra arrays.
+func readArrays(t *testing.T, c *client.Client, n int) (values []string) {
+	timeout := time.After(10 * time.Second)
+	for len(values) < n {
+		select {
+		case a, ok := <-c.Arrays():
+			if !ok {
+				t.Fatalf("arrays closed after %v: %v", values, c.Err())
+			}
+			var array []string
+			json.Unmarshal(a.Data, &array)
+			values = append(values, array...)
+		case <-timeout:
+			t.Fatalf("timed out after %v", values)
+		}
+	}
+
+	select {
+	case a := <-c.Arrays():
+		t.Errorf("unexpected array %d %s", a.Id, a.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+	return
+}
+
+// Sends the maps through the proxy and checks that the client and the server
+// received exactly the expected arrays and maps. The server is reached through
+// a reverse proxy when reverse is true.
+func testProxy(t *testing.T, rule string, backChannel string, reverse bool) {
+	server := &echoServer{closed: make(chan bool, 1)}
+	backend := httptest.NewServer(bc.NewHandler(server.handleChannel))
+	defer backend.Close()
+
+	var proxy *Proxy
+	if reverse {
+		u, _ := url.Parse(backend.URL)
+		reverseProxy := httputil.NewSingleHostReverseProxy(u)
+		reverseProxy.FlushInterval = -1
+		proxy = New(reverseProxy)
+	} else {
+		proxy = New(backend.Config.Handler)
+	}
+	if len(rule) > 0 {
+		r, err := ParseRule(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy.AddRule(r)
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	c, err := client.Dial(s.URL+"/channel", &client.Options{
+		BackChannel: backChannel,
+		RetryDelay:  10 * time.Millisecond,
+		MaxRetries:  10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < batches*batchSize; i++ {
+		c.SendMap(map[string]string{"i": strconv.Itoa(i)})
+		if i%batchSize == batchSize-1 {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			err := c.Flush(ctx)
+			cancel()
+			if err != nil {
+				t.Fatalf("flush: %v", err)
+			}
+		}
+	}
+
+	expected := expectedValues()
+	if values := readArrays(t, c, len(expected)); !equalStrings(values, expected) {
+		t.Errorf("expected arrays %v, got %v", expected, values)
+	}
+
+	c.Close()
+	select {
+	case <-server.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the server channel to be closed")
+	}
+	if maps := server.getMaps(); !equalStrings(maps, expected) {
+		t.Errorf("expected maps %v, got %v", expected, maps)
+	}
+
+	if applied := proxy.Applied(); len(rule) > 0 && applied[0] == 0 {
+		t.Errorf("expected the rule to apply")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	cases := []struct {
+		rule        string
+		backChannel string
+	}{
+		{"", client.XmlHttp},
+		{"back drop chunk=0 times=3", client.XmlHttp},
+		{"back drop chunk=1 times=2", client.Html},
+		{"back truncate chunk=0 bytes=3 times=2", client.XmlHttp},
+		{"back truncate chunk=1 bytes=20 times=2", client.Html},
+		{"back fail status=500 times=2", client.XmlHttp},
+		{"back hold delay=200ms times=2", client.XmlHttp},
+		{"forward delay delay=100ms times=3", client.XmlHttp},
+		{"forward duplicate times=3", client.XmlHttp},
+		{"forward fail status=503 times=2", client.XmlHttp},
+		{"forward fail status=502 forward times=3", client.XmlHttp},
+		{"forward truncate chunk=0 bytes=2 skip=1 times=2", client.XmlHttp},
+		{"forward hold delay=200ms times=2", client.XmlHttp},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.rule+" "+c.backChannel, func(t *testing.T) {
+			t.Parallel()
+			testProxy(t, c.rule, c.backChannel, false)
+		})
+	}
+}
+
+func TestProxyReverse(t *testing.T) {
+	for _, rule := range []string{
+		"back drop chunk=0 times=2",
+		"back truncate chunk=1 bytes=3 times=2",
+		"forward duplicate times=2",
+	} {
+		rule := rule
+		t.Run(rule, func(t *testing.T) {
+			t.Parallel()
+			testProxy(t, rule, client.XmlHttp, true)
+		})
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	cases := []struct {
+		s        string
+		expected Rule
+		err      bool
+	}{
+		{"back drop", Rule{Target: BackChannel, Action: Drop}, false},
+		{"back truncate chunk=1 bytes=5 skip=2 times=3",
+			Rule{Target: BackChannel, Action: Truncate, Chunk: 1, Bytes: 5, Skip: 2, Times: 3}, false},
+		{"forward fail status=502 forward",
+			Rule{Target: ForwardChannel, Action: Fail, Status: 502, Forward: true}, false},
+		{"any hold delay=1.5s", Rule{Target: AnyRequest, Action: Hold, Delay: 1500 * time.Millisecond}, false},
+		{"back", Rule{}, true},
+		{"front drop", Rule{}, true},
+		{"back explode", Rule{}, true},
+		{"back drop chunk=-1", Rule{}, true},
+		{"back drop color=1", Rule{}, true},
+		{"back hold delay=soon", Rule{}, true},
+	}
+
+	for _, c := range cases {
+		rule, err := ParseRule(c.s)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", c.s, rule)
+			}
+			continue
+		}
+		if err != nil || rule != c.expected {
+			t.Errorf("%q: expected %v, got %v (%v)", c.s, c.expected, rule, err)
+		}
+		if rule.String() != c.s {
+			t.Errorf("expected %q, got %q", c.s, rule.String())
+		}
+	}
+}
@@ -6,6 +6,7 @@
 package browserchannel
 
 import (
+	"context"
 	crand "crypto/rand"
 	"encoding/json"
 	"io"
@@ -28,6 +29,8 @@ const (
 	DefaultBindPath = "bind"
 	// The path for the test connection.
 	DefaultTestPath = "test"
+	// The path for the WebSocket connection.
+	DefaultWebSocketPath = "ws"
 )
 
 type queryType int
@@ -90,15 +93,30 @@ type bindParams struct {
 	chunked bool
 	values  url.Values
 	method  string
+	gzip    bool
+	// The metadata of the request, see RequestInfo.
+	request *RequestInfo
+	// The context of the request, cancelled when the client goes away.
+	ctx context.Context
 }
 
-func parseBindParams(req *http.Request, values url.Values) (params *bindParams, err error) {
-	cver := req.Form.Get("VER")
+// Returns the client version of the request creating a session. The client
+// version is only sent on the initial bind request, when set on the client.
+// Fallback to the protocol version otherwise.
+func parseClientVersion(req *http.Request) string {
+	if cver := req.Form.Get("CVER"); len(cver) > 0 {
+		return cver
+	}
+	return req.Form.Get("VER")
+}
+
+func parseBindParams(req *http.Request, values url.Values, signer *SessionIdSigner) (params *bindParams, err error) {
+	cver := parseClientVersion(req)
 	qtype := parseQueryType(req.Form.Get("TYPE"))
 	domain := req.Form.Get("DOMAIN")
 	rid := req.Form.Get("zx")
 	chunked := req.Form.Get("CI") == "0"
-	sid, err := parseSessionId(req.Form.Get("SID"))
+	sid, _, _, err := signer.parse(req.Form.Get("SID"))
 	if err != nil {
 		return
 	}
@@ -106,7 +124,8 @@ func parseBindParams(req *http.Request, values url.Values) (params *bindParams,
 	if err != nil {
 		return
 	}
-	params = &bindParams{cver, sid, qtype, domain, rid, aid, chunked, values, req.Method}
+	gzip := acceptsGzip(req)
+	params = &bindParams{cver, sid, qtype, domain, rid, aid, chunked, values, req.Method, gzip, nil, req.Context()}
 	return
 }
 
@@ -129,13 +148,13 @@ var headers = map[string]string{
 	"Cache-Control":          "no-cache, no-store, max-age=0, must-revalidate",
 	"Expires":                "Fri, 01 Jan 1990 00:00:00 GMT",
 	"X-Content-Type-Options": "nosniff",
-	"Transfer-Encoding":      "chunked",
 	"Pragma":                 "no-cache",
 }
 
 type channelMap struct {
 	sync.RWMutex
-	m map[SessionId]*Channel
+	m        map[SessionId]*Channel
+	shutdown bool
 }
 
 func (m *channelMap) get(sid SessionId) *Channel {
@@ -144,20 +163,37 @@ func (m *channelMap) get(sid SessionId) *Channel {
 	return m.m[sid]
 }
 
-func (m *channelMap) set(sid SessionId, channel *Channel) {
+// Adds the channel to the map unless the map was shut down.
+func (m *channelMap) set(sid SessionId, channel *Channel) (ok bool) {
 	m.Lock()
 	defer m.Unlock()
-	m.m[sid] = channel
+	if !m.shutdown {
+		m.m[sid] = channel
+		ok = true
+	}
+	return
 }
 
-func (m *channelMap) del(sid SessionId) (deleted bool) {
+func (m *channelMap) del(sid SessionId) (channel *Channel) {
 	m.Lock()
 	defer m.Unlock()
-	_, deleted = m.m[sid]
+	channel = m.m[sid]
 	delete(m.m, sid)
 	return
 }
 
+// Prevents channels from being added to the map and returns the channels it
+// contains.
+func (m *channelMap) shutdownAll() (channels []*Channel) {
+	m.Lock()
+	defer m.Unlock()
+	m.shutdown = true
+	for _, channel := range m.m {
+		channels = append(channels, channel)
+	}
+	return
+}
+
 // Contains the browser channel cross domain info for a single domain.
 type crossDomainInfo struct {
 	hostMatcher *regexp.Regexp
@@ -176,6 +212,9 @@ func getHostPrefix(info *crossDomainInfo) string {
 // goroutine for each new browser channel connection established.
 type ChannelHandler func(*Channel)
 
+// A ChannelHandler receiving the channel's context. See Channel.Context.
+type ContextChannelHandler func(context.Context, *Channel)
+
 // The browser channel http.Handler.
 type Handler struct {
 	corsInfo    *crossDomainInfo
@@ -183,23 +222,48 @@ type Handler struct {
 	channels    *channelMap
 	bindPath    string
 	testPath    string
+	wsPath      string
 	gcChan      chan SessionId
 	chanHandler ChannelHandler
+	webChannel  bool
+	compression bool
+	settings    channelSettings
+	limiter     *sessionLimiter
+	clientKey   ClientKeyFunc
+	mapLimits   MapLimits
+	signer      *SessionIdSigner
+	recorder    *Recorder
+	prefixNodes map[string]string
+	backplane   Backplane
+	unsubscribe func()
 }
 
 // Creates a new browser channel HTTP handler. The last path segment of the
-// URL is used to distinguish bind and test connections.
+// URL is used to distinguish bind and test connections, see SetPaths and
+// SetPrefix.
 func NewHandler(chanHandler ChannelHandler) (h *Handler) {
 	h = new(Handler)
 	h.channels = &channelMap{m: make(map[SessionId]*Channel)}
 	h.bindPath = DefaultBindPath
 	h.testPath = DefaultTestPath
+	h.wsPath = DefaultWebSocketPath
 	h.gcChan = make(chan SessionId, 10)
 	h.chanHandler = chanHandler
+	h.limiter = newSessionLimiter()
+	h.clientKey = RemoteAddrKey
+	h.SetMapLimits(DefaultMapLimits)
 	go h.removeClosedSession()
 	return
 }
 
+// Creates a new browser channel HTTP handler invoking a channel handler that
+// receives the context of each channel.
+func NewContextHandler(chanHandler ContextChannelHandler) *Handler {
+	return NewHandler(func(c *Channel) {
+		chanHandler(c.Context(), c)
+	})
+}
+
 // Sets the cross domain information for this browser channel. The origin is
 // used as the Access-Control-Allow-Origin header value and should respect the
 // format specified by http://www.w3.org/TR/cors/. The prefixes are used to set
@@ -209,6 +273,145 @@ func (h *Handler) SetCrossDomainPrefix(domain string, prefixes []string) {
 	h.corsInfo = &crossDomainInfo{makeOriginMatcher(domain), domain, prefixes}
 }
 
+// Sets the paths of the bind, test and WebSocket connections, relative to the
+// handler's prefix. The paths are matched against whole path segments and may
+// contain several segments, e.g. "v2/bind". An empty path disables the
+// corresponding connections. The paths default to DefaultBindPath,
+// DefaultTestPath and DefaultWebSocketPath.
+func (h *Handler) SetPaths(bindPath, testPath, webSocketPath string) {
+	h.bindPath = strings.Trim(bindPath, "/")
+	h.testPath = strings.Trim(testPath, "/")
+	h.wsPath = strings.Trim(webSocketPath, "/")
+}
+
+// Sets the path under which the handler is mounted, e.g. "/channel". Requests
+// are then only served when their path is the prefix followed by the bind,
+// test or WebSocket path, which allows several handlers to be mounted on the
+// same server without ambiguity. See Mux. There is no prefix by default.
+func (h *Handler) SetPrefix(prefix string) {
+	h.prefix = cleanPrefix(prefix)
+}
+
+// Enables the goog.net.WebChannel extensions of the protocol: the headers and
+// body passed as URL parameters, the JSON encoded maps, the session id header
+// and the negotiation of protocol versions newer than SupportedProcolVersion.
+// BrowserChannel clients are still supported when the extensions are enabled.
+func (h *Handler) SetWebChannel(enabled bool) {
+	h.webChannel = enabled
+}
+
+// Enables the compression of the XHR back channels of the clients accepting
+// gzip encoded responses. Each chunk is flushed through the compressor, which
+// adds a few bytes to the small chunks, so compression only pays off when
+// large arrays are sent. Disabled by default.
+func (h *Handler) SetCompression(enabled bool) {
+	h.compression = enabled
+}
+
+// Enables the coalescing of outgoing arrays. Instead of being sent right away,
+// the arrays are accumulated for the given delay, or until their size reaches
+// maxBytes when maxBytes is positive, and then sent in a single chunk. A zero
+// delay disables coalescing, which is the default. See Channel.Flush.
+func (h *Handler) SetCoalescing(delay time.Duration, maxBytes int) {
+	h.settings.coalesceDelay = delay
+	h.settings.coalesceBytes = maxBytes
+}
+
+// Sets the limits of the per channel queue holding the arrays that weren't
+// acknowledged by the client. The queue is unbounded by default.
+func (h *Handler) SetQueueLimits(limits QueueLimits) {
+	h.settings.queueLimits = limits
+}
+
+// Enables the escaping of the non-ASCII characters of the outgoing arrays as
+// \uXXXX sequences, for clients or intermediaries that mishandle UTF-8 encoded
+// responses. Disabled by default.
+func (h *Handler) SetAsciiOnly(enabled bool) {
+	h.settings.asciiOnly = enabled
+}
+
+// Sets the limits on the sessions served by the handler. Requests exceeding
+// the limits are refused with a 503 status code, or a 429 status code when the
+// session creation rate is exceeded, which the client treats as a transient
+// failure. There are no limits by default.
+func (h *Handler) SetSessionLimits(limits SessionLimits) {
+	h.limiter.setLimits(limits)
+	h.settings.maxBackChannels = limits.MaxBackChannels
+}
+
+// Sets the function identifying the client that made a request for the
+// purpose of the per client session limits. Clients are identified by their
+// IP address by default, see RemoteAddrKey.
+func (h *Handler) SetClientKeyFunc(clientKey ClientKeyFunc) {
+	h.clientKey = clientKey
+}
+
+// Sets the limits on the forward channel requests and on the maps they carry.
+// Requests exceeding the limits are refused with a 413 status code. See
+// DefaultMapLimits for the limits used by default.
+func (h *Handler) SetMapLimits(limits MapLimits) {
+	h.mapLimits = limits
+	h.settings.mapQueueCapacity = limits.queueCapacity()
+}
+
+// Sets the callback receiving the maps that the client failed to serialize or
+// that exceed the map limits. Such maps are acknowledged, which keeps the
+// channel open, but aren't delivered on the map channel.
+func (h *Handler) SetBadMapHandler(badMapHandler BadMapHandler) {
+	h.settings.badMapHandler = badMapHandler
+}
+
+// Sets the signer of the session ids. Requests carrying a session id that
+// can't be verified by the signer, e.g. one issued before the signer was set,
+// or a session id issued by another node are told that the session id is
+// unknown without looking up the session, so their clients create a new
+// session. Session ids aren't signed by default.
+func (h *Handler) SetSessionIdSigner(signer *SessionIdSigner) {
+	h.signer = signer
+}
+
+// Maps host prefixes to the ids of the nodes of a cluster. The prefix handed
+// to a new session is chosen among the prefixes mapped to the node id of the
+// handler's SessionIdSigner, so the requests made on the prefixed host can be
+// routed to the node owning the session. See Forwarder.
+func (h *Handler) SetHostPrefixNodes(nodes map[string]string) {
+	h.prefixNodes = nodes
+}
+
+// Returns the host prefix handed to a new session.
+func (h *Handler) hostPrefix() string {
+	if h.signer != nil {
+		var prefixes []string
+		for prefix, node := range h.prefixNodes {
+			if node == h.signer.NodeId() {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+		if len(prefixes) > 0 {
+			return prefixes[rand.Intn(len(prefixes))]
+		}
+	}
+	return getHostPrefix(h.corsInfo)
+}
+
+// Creates the writer of a back channel response.
+func (h *Handler) newChunkWriter(rw http.ResponseWriter, params *bindParams) *chunkWriter {
+	compress := h.compression && params.gzip && params.qtype != queryHtml
+	return newChunkWriter(rw, compress)
+}
+
+// Closes all the channels with the CloseHandlerShutdown reason and cancels the
+// backplane subscription. New sessions are refused with a 503 status code
+// afterwards.
+func (h *Handler) Shutdown() {
+	if h.unsubscribe != nil {
+		h.unsubscribe()
+	}
+	for _, channel := range h.channels.shutdownAll() {
+		channel.CloseWithReason(CloseHandlerShutdown, "")
+	}
+}
+
 // Removes closed channels from the handler's channel map.
 func (h *Handler) removeClosedSession() {
 	for {
@@ -219,13 +422,34 @@ func (h *Handler) removeClosedSession() {
 
 		log.Printf("removing %s from session map\n", sid)
 
-		if !h.channels.del(sid) {
+		if channel := h.channels.del(sid); channel != nil {
+			h.limiter.release(channel.clientKey, time.Now())
+			if store := h.settings.store; store != nil {
+				if err := store.Remove(sid); err != nil {
+					log.Printf("failed to remove %s from store: %s\n", sid, err)
+				}
+			}
+		} else {
 			log.Printf("missing channel for %s in session map\n", sid)
 		}
 	}
 }
 
 func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	route := h.route(req.URL.Path)
+	if h.recorder != nil && len(route) > 0 && route != h.wsPath {
+		w := h.recorder.begin(rw, req)
+		defer w.end()
+		rw = w
+	}
+
+	if h.webChannel {
+		applyHeadersOverride(req)
+		if req.Header.Get(webChannelProtocolHeader) == webChannelProtocol {
+			rw.Header().Set(webChannelProtocolHeader, webChannelProtocol)
+		}
+	}
+
 	// The CORS  spec only supports *, null or the exact domain.
 	// http://www.w3.org/TR/cors/#access-control-allow-origin-response-header
 	// http://tools.ietf.org/html/rfc6454#section-7.1
@@ -238,36 +462,78 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 	// The body is parsed before calling ParseForm so the values don't get
 	// collapsed into a single collection.
-	values, err := parseBody(req.Body)
+	if h.mapLimits.MaxBodySize > 0 && req.ContentLength > h.mapLimits.MaxBodySize {
+		rw.WriteHeader(413)
+		return
+	}
+
+	values, err := parseBody(req.Body, &h.mapLimits)
+	if err == nil && h.webChannel {
+		err = mergeBodyParam(req, values)
+	}
 	if err != nil {
-		rw.WriteHeader(400)
+		writeBodyError(rw, err)
 		return
 	}
 
 	req.ParseForm()
 
-	path := req.URL.Path
-	if strings.HasSuffix(path, h.testPath) {
+	// The route is empty when the path doesn't match, which must be checked
+	// first since disabled paths are empty too.
+	switch route {
+	case "":
+		rw.WriteHeader(404)
+	case h.testPath:
 		h.handleTestRequest(rw, parseTestParams(req))
-	} else if strings.HasSuffix(path, h.bindPath) {
-		params, err := parseBindParams(req, values)
-		if err != nil {
+	case h.bindPath:
+		params, err := parseBindParams(req, values, h.signer)
+		if err == errForeignSessionId {
+			log.Printf("foreign session %s\n", req.Form.Get("SID"))
+			writeUnknownSid(rw)
+			return
+		} else if isUnknownSessionId(err) {
+			log.Printf("unknown session %s: %s\n", req.Form.Get("SID"), err)
+			writeUnknownSid(rw)
+			return
+		} else if err != nil {
 			rw.WriteHeader(400)
 			return
 		}
+		params.request = newRequestInfo(req, h.clientKey(req))
 		h.handleBindRequest(rw, params)
-	} else {
-		rw.WriteHeader(404)
+	case h.wsPath:
+		h.handleWebSocket(rw, req)
 	}
 }
 
+// Returns the bind, test or WebSocket path matched by the request path, or an
+// empty string. When the handler has a prefix, the request path must be the
+// prefix followed by one of the paths. Otherwise, the request path must end
+// with one of the paths on a segment boundary, e.g. /channel/test matches the
+// test path but /contest doesn't.
+func (h *Handler) route(path string) string {
+	for _, p := range []string{h.testPath, h.bindPath, h.wsPath} {
+		if len(p) == 0 {
+			continue
+		}
+		if len(h.prefix) > 0 {
+			if path == h.prefix+"/"+p {
+				return p
+			}
+		} else if path == p || path == "/"+p || strings.HasSuffix(path, "/"+p) {
+			return p
+		}
+	}
+	return ""
+}
+
 func (h *Handler) handleTestRequest(rw http.ResponseWriter, params *testParams) {
-	if params.ver != SupportedProcolVersion {
+	if _, ok := negotiateVersion(params.ver, h.webChannel); !ok {
 		rw.WriteHeader(400)
 		io.WriteString(rw, "Unsupported protocol version.")
 	} else if params.init {
 		rw.WriteHeader(200)
-		io.WriteString(rw, "[\""+getHostPrefix(h.corsInfo)+"\",\"\"]")
+		io.WriteString(rw, "[\""+h.hostPrefix()+"\",\"\"]")
 	} else {
 		params.qtype.setContentType(rw)
 		setHeaders(rw, &headers)
@@ -287,9 +553,13 @@ func (h *Handler) handleTestRequest(rw http.ResponseWriter, params *testParams)
 		// chunking support by setting the CI parameter to 1 which tells the
 		// server to close bind requests immediately. For reference, see
 		// goog.net.BrowserTestChannel#onRequestComplete.
-		rw.(http.Flusher).Flush()
-
-		time.Sleep(2 * time.Second)
+		//
+		// When the response can't be flushed, e.g. behind a middleware that
+		// buffers it, both results are sent at once so the client disables
+		// the chunking right away.
+		if flush(rw) == nil {
+			time.Sleep(2 * time.Second)
+		}
 
 		if params.qtype == queryHtml {
 			writeHtmlRpc(rw, "2")
@@ -300,6 +570,15 @@ func (h *Handler) handleTestRequest(rw http.ResponseWriter, params *testParams)
 	}
 }
 
+// Signals an unknown session id to the client using a 400 status code and a
+// message containing 'Unknown SID'. See goog/net/channelrequest.js for more
+// context on how this error is handled.
+func writeUnknownSid(rw http.ResponseWriter) {
+	setHeaders(rw, &headers)
+	rw.WriteHeader(400)
+	io.WriteString(rw, "Unknown SID")
+}
+
 func (h *Handler) handleBindRequest(rw http.ResponseWriter, params *bindParams) {
 	var channel *Channel
 	sid := params.sid
@@ -313,20 +592,19 @@ func (h *Handler) handleBindRequest(rw http.ResponseWriter, params *bindParams)
 		channel = h.channels.get(sid)
 		if channel == nil {
 			log.Printf("failed to lookup session %s\n", sid)
-			setHeaders(rw, &headers)
-			rw.WriteHeader(400)
-			io.WriteString(rw, "Unknown SID")
+			writeUnknownSid(rw)
 			return
 		}
 	}
 
 	if channel == nil {
-		sid, _ = generateSesionId(crand.Reader)
-		log.Printf("creating session %s\n", sid)
-		channel = newChannel(params.cver, sid, h.gcChan, h.corsInfo)
-		h.channels.set(sid, channel)
-		channel.armChannelTimeout()
-		go h.chanHandler(channel)
+		var err error
+		if channel, err = h.createChannel(params.cver, params.request); err != nil {
+			log.Printf("refusing session: %s\n", err)
+			writeLimitError(rw, err)
+			return
+		}
+		setRecordedSid(rw, channel.sidString)
 	}
 
 	if params.aid != -1 {
@@ -343,23 +621,74 @@ func (h *Handler) handleBindRequest(rw http.ResponseWriter, params *bindParams)
 	}
 }
 
+// Creates a new session and hands it to the channel handler. Fails if the
+// handler was shut down or if the session limits are exceeded.
+func (h *Handler) createChannel(cver string, request *RequestInfo) (channel *Channel, err error) {
+	if err = h.limiter.acquire(request.ClientKey, time.Now()); err != nil {
+		return
+	}
+	return h.openChannel(cver, request)
+}
+
+// Creates a new session for a client that already acquired it from the
+// limiter. The session is released if the handler was shut down.
+func (h *Handler) openChannel(cver string, request *RequestInfo) (channel *Channel, err error) {
+	clientKey := request.ClientKey
+	sid, _ := generateSesionId(crand.Reader)
+	log.Printf("creating session %s\n", sid)
+	channel = newChannel(cver, sid, h.gcChan, h.hostPrefix(), h.settings)
+	channel.clientKey = clientKey
+	channel.request = request
+	channel.sidString = h.signer.sign(sid, time.Now())
+	if !h.channels.set(sid, channel) {
+		// The channel isn't in the session map, so the garbage collection
+		// only stops it and the limiter is released here.
+		channel.terminate(CloseHandlerShutdown)
+		h.limiter.release(clientKey, time.Now())
+		return nil, errShutdown
+	}
+	channel.storeSession()
+	channel.armChannelTimeout()
+	go h.chanHandler(channel)
+	return
+}
+
 func (h *Handler) handleBindPost(rw http.ResponseWriter, params *bindParams, channel *Channel) {
-	offset, maps, err := parseIncomingMaps(params.values)
+	offset, maps, bad, err := parseIncomingMaps(params.values, &h.mapLimits)
 	if err != nil {
-		rw.WriteHeader(400)
+		writeBodyError(rw, err)
 		return
 	}
 
-	if err := channel.receiveMaps(offset, maps); err != nil {
+	if h.webChannel {
+		for i, m := range maps {
+			maps[i] = decodeWebChannelMap(m)
+		}
+	}
+
+	// The maps are refused with a 503 only if the application doesn't catch
+	// up in time, in which case the client sends them again later. Maps that
+	// can never fit in the map queue are refused like the requests exceeding
+	// the map limits.
+	if err := channel.receiveMapsWait(params.ctx, params.request, offset, maps, bad); err == errPendingMapsFull {
+		log.Printf("%s: %s\n", channel.Sid, err)
+		rw.WriteHeader(503)
+		return
+	} else if err != nil {
 		log.Printf("%s: %s\n", channel.Sid, err)
-		rw.WriteHeader(500)
+		rw.WriteHeader(413)
 		return
 	}
 
-	if channel.state == channelInit {
+	// The initial bind request, i.e. the one without a session id, creates
+	// the channel and is used as its first back channel.
+	if params.sid == nullSessionId {
 		setHeaders(rw, &headers)
-		rw.WriteHeader(200)
-		rw.(http.Flusher).Flush()
+		if h.webChannel {
+			rw.Header().Set(webChannelSessionIdHeader, channel.sidString)
+		}
+		out := h.newChunkWriter(rw, params)
+		out.start()
 
 		// The initial forward request is used as a back channel to send the
 		// server configuration: ['c', id, host, version]. This payload has to
@@ -367,9 +696,9 @@ func (h *Handler) handleBindPost(rw http.ResponseWriter, params *bindParams, cha
 		// channel. Note that the first bind request made by IE<10 does not
 		// contain a TYPE=html query parameter and therefore receives the same
 		// length prefixed array reply as is sent to the XHR streaming clients.
-		backChannel := newBackChannel(channel.Sid, rw, false, "", params.rid)
+		backChannel := newBackChannel(channel.Sid, out, false, "", params.rid)
 		channel.setBackChannel(backChannel)
-		backChannel.wait()
+		backChannel.wait(params.ctx, channel)
 	} else {
 		// On normal forward channel request, the session status is returned
 		// to the client. The session status contains 3 pieces of information:
@@ -378,24 +707,135 @@ func (h *Handler) handleBindPost(rw http.ResponseWriter, params *bindParams, cha
 		b, _ := json.Marshal(channel.getState())
 		setHeaders(rw, &headers)
 		rw.WriteHeader(200)
-		io.WriteString(rw, strconv.FormatInt(int64(len(b)), 10)+"\n")
-		rw.Write(b)
+		rw.Write(lengthPrefixed(b))
 	}
 }
 
 func (h *Handler) handleBindGet(rw http.ResponseWriter, params *bindParams, channel *Channel) {
 	if params.qtype == queryTerminate {
-		channel.terminate()
+		channel.terminate(CloseClientTerminated)
 	} else {
+		if !channel.acquireBackChannel() {
+			writeLimitError(rw, errTooManyBackChannels)
+			return
+		}
+		defer channel.releaseBackChannel()
+
 		params.qtype.setContentType(rw)
 		setHeaders(rw, &headers)
-		rw.WriteHeader(200)
-		rw.(http.Flusher).Flush()
+		out := h.newChunkWriter(rw, params)
+		out.start()
 
 		isHtml := params.qtype == queryHtml
-		bc := newBackChannel(channel.Sid, rw, isHtml, params.domain, params.rid)
-		bc.setChunked(params.chunked)
+		bc := newBackChannel(channel.Sid, out, isHtml, params.domain, params.rid)
+		// A back channel that can't be flushed is closed after its first
+		// chunk so the client receives the arrays without delay.
+		bc.setChunked(params.chunked && canFlush(rw))
 		channel.setBackChannel(bc)
-		bc.wait()
+		bc.wait(params.ctx, channel)
 	}
 }
+
+// Returns whether the origin of the request may open a WebSocket connection.
+// Browsers don't apply CORS to WebSocket connections, so the handler must
+// reject the pages of other origins itself. Requests without an origin don't
+// come from browsers.
+func (h *Handler) isAllowedOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, req.Host) {
+		return true
+	}
+	return h.corsInfo != nil && h.corsInfo.hostMatcher.MatchString(origin)
+}
+
+// Handles a WebSocket connection. A WebSocket connection without a SID
+// parameter creates a new session while a connection with a SID parameter
+// resumes an existing session, in which case the unacknowledged arrays are
+// sent again. The AID parameter acknowledges arrays as it does on bind
+// requests.
+func (h *Handler) handleWebSocket(rw http.ResponseWriter, req *http.Request) {
+	var channel *Channel
+
+	if !h.isAllowedOrigin(req) {
+		log.Printf("websocket from foreign origin %s\n", req.Header.Get("Origin"))
+		rw.WriteHeader(403)
+		return
+	}
+
+	sid, _, _, err := h.signer.parse(req.Form.Get("SID"))
+	if err == errForeignSessionId {
+		log.Printf("foreign session %s\n", req.Form.Get("SID"))
+		writeUnknownSid(rw)
+		return
+	} else if isUnknownSessionId(err) {
+		log.Printf("unknown session %s: %s\n", req.Form.Get("SID"), err)
+		writeUnknownSid(rw)
+		return
+	} else if err != nil {
+		rw.WriteHeader(400)
+		return
+	}
+
+	aid, err := parseAid(req.Form.Get("AID"))
+	if err != nil {
+		rw.WriteHeader(400)
+		return
+	}
+	request := newRequestInfo(req, h.clientKey(req))
+
+	if sid != nullSessionId {
+		channel = h.channels.get(sid)
+		if channel == nil {
+			log.Printf("failed to lookup session %s\n", sid)
+			writeUnknownSid(rw)
+			return
+		}
+	}
+
+	// A new session is only created once the upgrade is accepted, but its
+	// slot is reserved beforehand so the limits are reported over HTTP.
+	if channel == nil {
+		if err = h.limiter.acquire(request.ClientKey, time.Now()); err != nil {
+			log.Printf("refusing session: %s\n", err)
+			writeLimitError(rw, err)
+			return
+		}
+	} else if !channel.acquireBackChannel() {
+		writeLimitError(rw, errTooManyBackChannels)
+		return
+	}
+
+	ws, err := acceptWebSocket(rw, req)
+	if err != nil {
+		log.Printf("websocket handshake failed: %s\n", err)
+		if channel == nil {
+			h.limiter.release(request.ClientKey, time.Now())
+		} else {
+			channel.releaseBackChannel()
+		}
+		return
+	}
+
+	if channel == nil {
+		if channel, err = h.openChannel(parseClientVersion(req), request); err != nil {
+			log.Printf("refusing session: %s\n", err)
+			ws.writeClose(wsCloseGoingAway)
+			ws.close()
+			return
+		}
+		channel.acquireBackChannel()
+	}
+	defer channel.releaseBackChannel()
+
+	if aid != -1 {
+		channel.acknowledgeArrays(aid)
+	}
+
+	bc := newWebSocketBackChannel(channel.Sid, ws, req.Form.Get("zx"))
+	channel.setBackChannel(bc)
+	go bc.receive(channel, request, &h.mapLimits)
+	bc.wait(req.Context(), channel)
+}
@@ -0,0 +1,431 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/MathieuTurcotte/go-browserchannel/browserchannel/client"
+	"github.com/MathieuTurcotte/go-browserchannel/browserchannel/faultproxy"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A middleware response writer that doesn't implement http.Flusher but gives
+// access to the response writer it wraps.
+type unwrappableResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *unwrappableResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// A middleware response writer hiding the response writer it wraps.
+type opaqueResponseWriter struct {
+	http.ResponseWriter
+}
+
+// A browser channel client talking to a test server.
+type testClient struct {
+	t        *testing.T
+	server   *httptest.Server
+	channels chan *Channel
+	sid      string
+}
+
+func newTestClient(t *testing.T, http2 bool, wrap func(http.ResponseWriter) http.ResponseWriter) *testClient {
+	c := &testClient{t: t, channels: make(chan *Channel, 1)}
+
+	h := NewHandler(func(channel *Channel) { c.channels <- channel })
+	c.server = httptest.NewUnstartedServer(http.HandlerFunc(
+		func(rw http.ResponseWriter, req *http.Request) {
+			h.ServeHTTP(wrap(rw), req)
+		}))
+
+	if http2 {
+		c.server.EnableHTTP2 = true
+		c.server.StartTLS()
+	} else {
+		c.server.Start()
+	}
+	return c
+}
+
+func (c *testClient) close() {
+	c.server.CloseClientConnections()
+	c.server.Close()
+}
+
+func (c *testClient) do(method string, query string, body string) *http.Response {
+	req, _ := http.NewRequest(method, c.server.URL+"/channel/"+query, strings.NewReader(body))
+	if method == "POST" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := c.server.Client().Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		c.t.Fatalf("%s %s: unexpected status %d", method, query, resp.StatusCode)
+	}
+	return resp
+}
+
+// Reads a length prefixed chunk.
+func readChunk(t *testing.T, r *bufio.Reader) string {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		t.Fatalf("bad chunk length %q", line)
+	}
+	chunk := make([]byte, length)
+	if _, err := io.ReadFull(r, chunk); err != nil {
+		t.Fatal(err)
+	}
+	return string(chunk)
+}
+
+// Opens a session and returns its channel.
+func (c *testClient) open() *Channel {
+	resp := c.do("POST", "bind?VER=8&CVER=8&RID=1&zx=a&t=1", "count=0")
+	defer resp.Body.Close()
+
+	chunk := readChunk(c.t, bufio.NewReader(resp.Body))
+	var raw [][]json.RawMessage
+	if err := json.Unmarshal([]byte(chunk), &raw); err != nil {
+		c.t.Fatal(err)
+	}
+	if len(raw) != 1 || len(raw[0]) != 2 {
+		c.t.Fatalf("expected the 'c' array, got %s", chunk)
+	}
+	var array []interface{}
+	if err := json.Unmarshal(raw[0][1], &array); err != nil || len(array) < 2 || array[0] != "c" {
+		c.t.Fatalf("expected the 'c' array, got %s", chunk)
+	}
+	c.sid = array[1].(string)
+
+	select {
+	case channel := <-c.channels:
+		return channel
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("expected a channel")
+	}
+	return nil
+}
+
+func (c *testClient) backChannelQuery() string {
+	return "bind?VER=8&SID=" + c.sid + "&RID=rpc&AID=1&CI=0&TYPE=xmlhttp&zx=b&t=1"
+}
+
+func testStreaming(t *testing.T, http2 bool, wrap func(http.ResponseWriter) http.ResponseWriter) {
+	c := newTestClient(t, http2, wrap)
+	defer c.close()
+
+	channel := c.open()
+	defer channel.Close()
+
+	// Forward channel.
+	resp := c.do("POST", "bind?VER=8&SID="+c.sid+"&RID=2&AID=1&zx=c&t=1", "count=1&ofs=0&req0_k=v")
+	if state := readChunk(t, bufio.NewReader(resp.Body)); state != "[0,1,0]" {
+		t.Errorf("expected state [0,1,0], got %s", state)
+	}
+	resp.Body.Close()
+	if m := <-channel.Maps(); m["k"] != "v" {
+		t.Errorf("expected map, got %v", m)
+	}
+
+	// Back channel, whose chunks are received as they are sent. The headers
+	// of a compressed response are only sent with its first chunk, so an
+	// array is queued before the back channel is opened.
+	channel.SendArray(Array{0})
+	resp = c.do("GET", c.backChannelQuery(), "")
+	defer resp.Body.Close()
+	if http2 && resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %s", resp.Proto)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			channel.SendArray(Array{i})
+		}
+		expected := "[[" + strconv.Itoa(i+2) + ",[" + strconv.Itoa(i) + "]]]"
+		if chunk := readChunk(t, r); chunk != expected {
+			t.Errorf("expected %s, got %s", expected, chunk)
+		}
+	}
+}
+
+func TestHandlerHTTP1(t *testing.T) {
+	testStreaming(t, false, func(rw http.ResponseWriter) http.ResponseWriter { return rw })
+}
+
+func TestHandlerHTTP2(t *testing.T) {
+	testStreaming(t, true, func(rw http.ResponseWriter) http.ResponseWriter { return rw })
+}
+
+func TestHandlerBehindUnwrappableMiddleware(t *testing.T) {
+	testStreaming(t, true, func(rw http.ResponseWriter) http.ResponseWriter {
+		return &unwrappableResponseWriter{rw}
+	})
+}
+
+func TestHandlerBehindOpaqueMiddleware(t *testing.T) {
+	c := newTestClient(t, false, func(rw http.ResponseWriter) http.ResponseWriter {
+		return &opaqueResponseWriter{rw}
+	})
+	defer c.close()
+
+	// The test request doesn't wait between the two results since they can't
+	// be sent separately.
+	start := time.Now()
+	resp := c.do("GET", "test?VER=8&TYPE=xmlhttp&zx=d&t=1", "")
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "111112" {
+		t.Errorf("expected 111112, got %s", body)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected an immediate response, took %s", elapsed)
+	}
+
+	channel := c.open()
+	defer channel.Close()
+
+	// The back channel is closed after its first chunk.
+	channel.SendArray(Array{"a"})
+	resp = c.do("GET", c.backChannelQuery(), "")
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "11\n[[2,[\"a\"]]]"; string(body) != expected {
+		t.Errorf("expected %q, got %q", expected, body)
+	}
+}
+
+func TestHandlerRoute(t *testing.T) {
+	h := NewHandler(func(*Channel) {})
+
+	unprefixed := []struct {
+		path     string
+		expected string
+	}{
+		{"/channel/test", "test"},
+		{"/channel/bind", "bind"},
+		{"/channel/ws", "ws"},
+		{"/test", "test"},
+		{"/contest", ""},
+		{"/channel/rebind", ""},
+		{"/channel/test/", ""},
+		{"/channel/test/other", ""},
+	}
+	for _, tc := range unprefixed {
+		if p := h.route(tc.path); p != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.path, tc.expected, p)
+		}
+	}
+
+	h.SetPrefix("channel/")
+	h.SetPaths("v2/bind", "/v2/test", "")
+
+	prefixed := []struct {
+		path     string
+		expected string
+	}{
+		{"/channel/v2/test", "v2/test"},
+		{"/channel/v2/bind", "v2/bind"},
+		{"/channel/ws", ""},
+		{"/channel/bind", ""},
+		{"/other/channel/v2/bind", ""},
+		{"/channel/nested/v2/bind", ""},
+	}
+	for _, tc := range prefixed {
+		if p := h.route(tc.path); p != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.path, tc.expected, p)
+		}
+	}
+}
+
+func TestHandlerDisabledPath(t *testing.T) {
+	h := NewHandler(func(*Channel) {})
+	h.SetPaths(DefaultBindPath, "", DefaultWebSocketPath)
+
+	for _, path := range []string{"/channel/test", "/channel/other"} {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("GET", path+"?VER=8&MODE=init", nil))
+		if rw.Code != 404 {
+			t.Errorf("%s: expected status 404, got %d", path, rw.Code)
+		}
+	}
+}
+
+func TestHandlerWaitsForLaggingApplication(t *testing.T) {
+	c := newTestClient(t, false, func(rw http.ResponseWriter) http.ResponseWriter { return rw })
+	defer c.close()
+
+	channel := c.open()
+	defer channel.Close()
+
+	// Each request fills the pending maps, so the last ones have to wait
+	// for the application to read its maps.
+	const requests = 4
+	statuses := make(chan int, requests)
+	go func() {
+		for i := 0; i < requests; i++ {
+			body := "count=" + strconv.Itoa(maxPendingMaps) + "&ofs=" + strconv.Itoa(i*maxPendingMaps)
+			for j := 0; j < maxPendingMaps; j++ {
+				body += "&req" + strconv.Itoa(j) + "_i=" + strconv.Itoa(i*maxPendingMaps+j)
+			}
+			query := "bind?VER=8&SID=" + c.sid + "&RID=" + strconv.Itoa(i+2) + "&AID=1&zx=c&t=1"
+			req, _ := http.NewRequest("POST", c.server.URL+"/channel/"+query, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			resp, err := c.server.Client().Do(req)
+			if err != nil {
+				statuses <- 0
+				continue
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < requests*maxPendingMaps; i++ {
+		select {
+		case m := <-channel.Maps():
+			if m["i"] != strconv.Itoa(i) {
+				t.Fatalf("expected map %d, got %v", i, m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for map %d", i)
+		}
+	}
+
+	for i := 0; i < requests; i++ {
+		if status := <-statuses; status != 200 {
+			t.Errorf("expected request %d to succeed, got %d", i, status)
+		}
+	}
+}
+
+func TestHandlerAcceptsLargeRequests(t *testing.T) {
+	c := newTestClient(t, false, func(rw http.ResponseWriter) http.ResponseWriter { return rw })
+	defer c.close()
+
+	channel := c.open()
+	defer channel.Close()
+
+	// More maps than the default capacity of the map queue, but within the
+	// default map limits.
+	const count = 500
+	body := "count=" + strconv.Itoa(count) + "&ofs=0"
+	for i := 0; i < count; i++ {
+		body += "&req" + strconv.Itoa(i) + "_i=" + strconv.Itoa(i)
+	}
+	statuses := make(chan int, 1)
+	go func() {
+		query := "bind?VER=8&SID=" + c.sid + "&RID=2&AID=1&zx=c&t=1"
+		req, _ := http.NewRequest("POST", c.server.URL+"/channel/"+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := c.server.Client().Do(req)
+		if err != nil {
+			statuses <- 0
+			return
+		}
+		resp.Body.Close()
+		statuses <- resp.StatusCode
+	}()
+
+	for i := 0; i < count; i++ {
+		select {
+		case m := <-channel.Maps():
+			if m["i"] != strconv.Itoa(i) {
+				t.Fatalf("expected map %d, got %v", i, m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for map %d", i)
+		}
+	}
+	if status := <-statuses; status != 200 {
+		t.Errorf("expected status 200, got %d", status)
+	}
+}
+
+// Holds the first back channel past the reopen timeout and checks that the
+// session is terminated and that the client can reconnect.
+func TestHandlerReopenTimeout(t *testing.T) {
+	reasons := make(chan error, 2)
+	h := NewHandler(func(c *Channel) {
+		for m := range c.Maps() {
+			c.SendArray(Array{m["i"]})
+		}
+		reasons <- c.Err()
+	})
+	h.settings.reopenTimeout = 100 * time.Millisecond
+
+	rule, err := faultproxy.ParseRule("back hold delay=500ms times=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := faultproxy.New(h, rule)
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	opts := &client.Options{RetryDelay: 10 * time.Millisecond, MaxRetries: 10}
+	c, err := client.Dial(server.URL+"/channel", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-reasons:
+		if reason, ok := err.(*CloseReason); !ok || reason.Code != CloseReopenTimeout {
+			t.Fatalf("expected a reopen timeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the server channel to be terminated")
+	}
+
+	select {
+	case a, ok := <-c.Arrays():
+		if ok {
+			t.Fatalf("unexpected array %d %s", a.Id, a.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the client to fail")
+	}
+	if err := c.Err(); err != client.ErrUnknownSid {
+		t.Fatalf("expected %v, got %v", client.ErrUnknownSid, err)
+	}
+
+	// The application reconnects with a new session.
+	if c, err = client.Dial(server.URL+"/channel", opts); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SendMap(map[string]string{"i": "0"})
+	select {
+	case a, ok := <-c.Arrays():
+		if !ok || string(a.Data) != `["0"]` {
+			t.Fatalf("expected [\"0\"], got %v: %v", a, c.Err())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the echoed array")
+	}
+
+	if applied := proxy.Applied(); applied[0] != 1 {
+		t.Errorf("expected the rule to apply once, applied %d times", applied[0])
+	}
+}
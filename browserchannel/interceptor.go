@@ -0,0 +1,117 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// The metadata of a request that created a channel or that carried maps. The
+// header and the query must not be modified.
+type RequestInfo struct {
+	RemoteAddr string
+	Header     http.Header
+	Query      url.Values
+	// The key identifying the client, see ClientKeyFunc.
+	ClientKey string
+	// The headers sent by WebChannel clients in the $httpHeaders URL
+	// parameter, nil when absent. They are set by the client and must not be
+	// trusted. Only the protocol and content type headers are applied to
+	// Header, when the request doesn't carry them.
+	HeaderOverrides http.Header
+}
+
+func newRequestInfo(req *http.Request, clientKey string) *RequestInfo {
+	return &RequestInfo{req.RemoteAddr, req.Header, req.URL.Query(), clientKey,
+		parseHeadersOverride(req)}
+}
+
+// A map waiting to be delivered on the map channel along with the request
+// that carried it.
+type pendingMap struct {
+	id  int
+	m   Map
+	req *RequestInfo
+}
+
+// Intercepts the maps received on a channel before they are delivered on the
+// map channel, once each and in order, along with the metadata of the request
+// that carried them. Returns the map to deliver, which may be modified or
+// replaced, nil to drop the map or an error to reject it. Rejected maps are
+// passed to the bad map handler, except when the error is a *CloseReason in
+// which case the channel is closed with that reason.
+//
+// Interceptors are called from the goroutine delivering the maps, without
+// holding the channel lock. An interceptor blocking to rate limit a client
+// delays the delivery of the following maps and eventually makes the client
+// send its maps again later, see Handler.SetMapLimits.
+type MapInterceptor func(c *Channel, req *RequestInfo, m Map) (Map, error)
+
+// Intercepts the arrays sent with SendArray and SendArrayWithOptions before
+// they are queued. Returns the array to send, which may be rewritten or
+// annotated, nil to drop the array or an error returned to the caller. The
+// arrays sent by the library itself, e.g. heartbeats, aren't intercepted. See
+// Channel.Request for the metadata of the request that created the channel.
+type ArrayInterceptor func(c *Channel, a Array) (Array, error)
+
+// Adds an interceptor of the maps received on the channels. The interceptors
+// are called in the order they were added and a map dropped or rejected by an
+// interceptor isn't passed to the following ones.
+func (h *Handler) AddMapInterceptor(interceptor MapInterceptor) {
+	h.settings.mapInterceptors = append(h.settings.mapInterceptors, interceptor)
+}
+
+// Adds an interceptor of the arrays sent on the channels. The interceptors are
+// called in the order they were added and an array dropped or refused by an
+// interceptor isn't passed to the following ones.
+func (h *Handler) AddArrayInterceptor(interceptor ArrayInterceptor) {
+	h.settings.arrayInterceptors = append(h.settings.arrayInterceptors, interceptor)
+}
+
+// Returns the metadata of the request that created the channel, or nil if the
+// channel was restored from an outgoing store.
+func (c *Channel) Request() *RequestInfo {
+	return c.request
+}
+
+// Runs the map interceptors. Returns nil if the map was dropped or rejected.
+func (c *Channel) interceptMap(p *pendingMap) (m Map) {
+	m = p.m
+	for _, interceptor := range c.settings.mapInterceptors {
+		var err error
+		if m, err = interceptor(c, p.req, m); err != nil {
+			c.rejectMap(p.id, err)
+			return nil
+		} else if m == nil {
+			c.log("map %d dropped by interceptor", p.id)
+			return nil
+		}
+	}
+	return
+}
+
+func (c *Channel) rejectMap(id int, err error) {
+	if reason, ok := err.(*CloseReason); ok {
+		c.log("map %d: closing channel: %s", id, reason)
+		c.CloseWithReason(reason.Code, reason.Message)
+		return
+	}
+
+	c.log("bad map %d: %s", id, err)
+	if c.settings.badMapHandler != nil {
+		c.settings.badMapHandler(c, &BadMap{Id: id, Err: err})
+	}
+}
+
+// Runs the array interceptors. Returns a nil array if the array was dropped.
+func (c *Channel) interceptArray(a Array) (Array, error) {
+	for _, interceptor := range c.settings.arrayInterceptors {
+		var err error
+		if a, err = interceptor(c, a); err != nil || a == nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
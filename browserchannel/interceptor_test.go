@@ -0,0 +1,132 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var errForbidden = errors.New("forbidden")
+
+func TestMapInterceptors(t *testing.T) {
+	var bad []*BadMap
+	var requests []*RequestInfo
+	c, _ := newTestChannel(channelSettings{
+		badMapHandler: func(c *Channel, b *BadMap) {
+			bad = append(bad, b)
+		},
+		mapInterceptors: []MapInterceptor{
+			func(c *Channel, req *RequestInfo, m Map) (Map, error) {
+				requests = append(requests, req)
+				switch m["op"] {
+				case "drop":
+					return nil, nil
+				case "reject":
+					return nil, errForbidden
+				}
+				return m, nil
+			},
+			func(c *Channel, req *RequestInfo, m Map) (Map, error) {
+				return Map{"op": m["op"], "user": req.ClientKey}, nil
+			},
+		},
+	})
+	defer c.terminate(CloseClientTerminated)
+
+	req1 := &RequestInfo{ClientKey: "alice"}
+	req2 := &RequestInfo{ClientKey: "bob"}
+	c.receiveMaps(req1, 0, []Map{{"op": "a"}, {"op": "drop"}, {"op": "reject"}}, nil)
+	// Maps received twice are only intercepted once.
+	c.receiveMaps(req2, 0, []Map{{"op": "a"}, {"op": "drop"}, {"op": "reject"}}, nil)
+	c.receiveMaps(req2, 3, []Map{{"op": "b"}}, nil)
+
+	for _, expected := range []Map{{"op": "a", "user": "alice"}, {"op": "b", "user": "bob"}} {
+		select {
+		case m := <-c.Maps():
+			if m["op"] != expected["op"] || m["user"] != expected["user"] {
+				t.Errorf("expected map %v, got %v", expected, m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected map %v", expected)
+		}
+	}
+
+	if len(requests) != 4 || requests[2] != req1 || requests[3] != req2 {
+		t.Errorf("expected 4 maps intercepted, got %v", requests)
+	}
+	if len(bad) != 1 || bad[0].Id != 2 || bad[0].Err != errForbidden {
+		t.Errorf("expected map 2 to be rejected, got %v", bad)
+	}
+}
+
+func TestMapInterceptorClosesChannel(t *testing.T) {
+	c, bc := newTestChannel(channelSettings{
+		mapInterceptors: []MapInterceptor{
+			func(c *Channel, req *RequestInfo, m Map) (Map, error) {
+				if m["token"] != "secret" {
+					return nil, &CloseReason{CloseApplication, "unauthorized"}
+				}
+				return m, nil
+			},
+		},
+	})
+	defer c.terminate(CloseClientTerminated)
+
+	c.receiveMaps(nil, 0, []Map{{"token": "guess"}}, nil)
+	waitMapsClosed(t, c)
+
+	reason := c.CloseReason()
+	if reason == nil || *reason != (CloseReason{CloseApplication, "unauthorized"}) {
+		t.Errorf("expected the channel to be closed, got %v", reason)
+	}
+	expected := []string{`[[2,["stop",1000,"unauthorized"]]]`}
+	if chunks := bc.getChunks(); !equalStrings(chunks, expected) {
+		t.Errorf("expected %v, got %v", expected, chunks)
+	}
+}
+
+func TestArrayInterceptors(t *testing.T) {
+	var count int
+	c, bc := newTestChannel(channelSettings{
+		arrayInterceptors: []ArrayInterceptor{
+			func(c *Channel, a Array) (Array, error) {
+				switch a[0] {
+				case "drop":
+					return nil, nil
+				case "refuse":
+					return nil, errForbidden
+				}
+				return a, nil
+			},
+			func(c *Channel, a Array) (Array, error) {
+				count++
+				return append(a, strconv.Itoa(count)), nil
+			},
+		},
+	})
+	defer c.terminate(CloseClientTerminated)
+
+	tests := []struct {
+		array Array
+		err   error
+	}{
+		{Array{"a"}, nil},
+		{Array{"drop"}, nil},
+		{Array{"refuse"}, errForbidden},
+		{Array{"b"}, nil},
+	}
+	for _, tc := range tests {
+		if err := c.SendArray(tc.array); err != tc.err {
+			t.Errorf("%v: expected error %v, got %v", tc.array, tc.err, err)
+		}
+	}
+
+	expected := []string{`[[2,["a","1"]]]`, `[[3,["b","2"]]]`}
+	if chunks := bc.getChunks(); !equalStrings(chunks, expected) {
+		t.Errorf("expected %v, got %v", expected, chunks)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errShutdown            = errors.New("handler shut down")
+	errTooManySessions     = errors.New("too many sessions")
+	errRateLimited         = errors.New("session creation rate exceeded")
+	errTooManyBackChannels = errors.New("too many back channels")
+)
+
+// Limits on the sessions served by a handler. Zero values mean no limit.
+type SessionLimits struct {
+	// The maximum number of concurrent sessions.
+	MaxSessions int
+	// The maximum number of concurrent sessions per client key.
+	MaxSessionsPerClient int
+	// The number of sessions a client can create per second, on average.
+	CreationRate float64
+	// The number of sessions a client can create in a burst. Defaults to 1
+	// when a creation rate is set.
+	CreationBurst int
+	// The maximum number of concurrent back channel requests per session.
+	MaxBackChannels int
+}
+
+// Returns the key identifying the client that made a request, e.g. its IP
+// address or an authenticated principal. Session limits are applied per key.
+type ClientKeyFunc func(*http.Request) string
+
+// The default ClientKeyFunc which identifies clients by their IP address.
+func RemoteAddrKey(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// The sessions and the session creation token bucket of a single client.
+type clientSessions struct {
+	sessions int
+	tokens   float64
+	last     time.Time
+}
+
+// Enforces the session limits of a handler.
+type sessionLimiter struct {
+	sync.Mutex
+	limits   SessionLimits
+	sessions int
+	clients  map[string]*clientSessions
+	acquires int
+}
+
+func newSessionLimiter() *sessionLimiter {
+	return &sessionLimiter{clients: make(map[string]*clientSessions)}
+}
+
+func (l *sessionLimiter) setLimits(limits SessionLimits) {
+	l.Lock()
+	defer l.Unlock()
+	l.limits = limits
+}
+
+func (l *sessionLimiter) burst() float64 {
+	if l.limits.CreationBurst > 0 {
+		return float64(l.limits.CreationBurst)
+	}
+	return 1
+}
+
+// Refills the client's token bucket.
+func (l *sessionLimiter) refill(client *clientSessions, now time.Time) {
+	elapsed := now.Sub(client.last).Seconds()
+	client.tokens += elapsed * l.limits.CreationRate
+	if burst := l.burst(); client.tokens > burst {
+		client.tokens = burst
+	}
+	client.last = now
+}
+
+// Reserves a session for the client identified by the given key.
+func (l *sessionLimiter) acquire(key string, now time.Time) (err error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.limits.MaxSessions > 0 && l.sessions >= l.limits.MaxSessions {
+		return errTooManySessions
+	}
+
+	client := l.client(key, now)
+
+	if l.limits.MaxSessionsPerClient > 0 &&
+		client.sessions >= l.limits.MaxSessionsPerClient {
+		return errTooManySessions
+	}
+
+	if l.limits.CreationRate > 0 {
+		l.refill(client, now)
+		if client.tokens < 1 {
+			return errRateLimited
+		}
+		client.tokens--
+	}
+
+	client.sessions++
+	l.sessions++
+
+	// Periodically forget the clients that have no sessions and a full
+	// bucket since they are indistinguishable from new clients.
+	if l.acquires++; l.acquires%1024 == 0 {
+		l.prune(now)
+	}
+
+	return
+}
+
+// Counts a session of the client identified by the given key regardless of
+// the limits, e.g. a restored session.
+func (l *sessionLimiter) add(key string, now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.client(key, now).sessions++
+	l.sessions++
+}
+
+// Returns the sessions of the client identified by the given key, creating
+// them if needed.
+func (l *sessionLimiter) client(key string, now time.Time) *clientSessions {
+	client, ok := l.clients[key]
+	if !ok {
+		client = &clientSessions{tokens: l.burst(), last: now}
+		l.clients[key] = client
+	}
+	return client
+}
+
+// Releases a session of the client identified by the given key.
+func (l *sessionLimiter) release(key string, now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+
+	if client, ok := l.clients[key]; ok {
+		client.sessions--
+		l.sessions--
+		l.refill(client, now)
+		if client.sessions == 0 && (l.limits.CreationRate == 0 || client.tokens >= l.burst()) {
+			delete(l.clients, key)
+		}
+	}
+}
+
+func (l *sessionLimiter) prune(now time.Time) {
+	for key, client := range l.clients {
+		l.refill(client, now)
+		if client.sessions == 0 && client.tokens >= l.burst() {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// Writes the response refusing a request because of the session limits. The
+// client treats non 200 responses as transient failures and retries later.
+func writeLimitError(rw http.ResponseWriter, err error) {
+	setHeaders(rw, &headers)
+	switch err {
+	case errRateLimited:
+		rw.Header().Set("Retry-After", strconv.Itoa(1))
+		rw.WriteHeader(429)
+	default:
+		rw.WriteHeader(503)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionLimiterMaxSessions(t *testing.T) {
+	l := newSessionLimiter()
+	l.setLimits(SessionLimits{MaxSessions: 2, MaxSessionsPerClient: 1})
+	now := time.Now()
+
+	if err := l.acquire("a", now); err != nil {
+		t.Fatalf("expected session to be accepted, got %v", err)
+	}
+	if err := l.acquire("a", now); err != errTooManySessions {
+		t.Fatalf("expected per client limit, got %v", err)
+	}
+	if err := l.acquire("b", now); err != nil {
+		t.Fatalf("expected session to be accepted, got %v", err)
+	}
+	if err := l.acquire("c", now); err != errTooManySessions {
+		t.Fatalf("expected global limit, got %v", err)
+	}
+
+	l.release("a", now)
+
+	if err := l.acquire("c", now); err != nil {
+		t.Fatalf("expected session to be accepted after release, got %v", err)
+	}
+}
+
+func TestSessionLimiterCreationRate(t *testing.T) {
+	l := newSessionLimiter()
+	l.setLimits(SessionLimits{CreationRate: 2, CreationBurst: 2})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if err := l.acquire("a", now); err != nil {
+			t.Fatalf("expected burst to be accepted, got %v", err)
+		}
+	}
+	if err := l.acquire("a", now); err != errRateLimited {
+		t.Fatalf("expected rate limit, got %v", err)
+	}
+	if err := l.acquire("b", now); err != nil {
+		t.Fatalf("expected other client to be accepted, got %v", err)
+	}
+
+	// Two sessions per second means a new token every 500ms.
+	if err := l.acquire("a", now.Add(500*time.Millisecond)); err != nil {
+		t.Fatalf("expected bucket to be refilled, got %v", err)
+	}
+}
+
+func TestSessionLimiterForgetsIdleClients(t *testing.T) {
+	l := newSessionLimiter()
+	l.setLimits(SessionLimits{CreationRate: 1})
+	now := time.Now()
+
+	l.acquire("a", now)
+	l.release("a", now.Add(time.Second))
+
+	if len(l.clients) != 0 {
+		t.Errorf("expected idle client to be forgotten, got %v", l.clients)
+	}
+}
+
+func TestHandlerRefusesSessions(t *testing.T) {
+	h := NewHandler(func(c *Channel) {})
+	h.SetSessionLimits(SessionLimits{MaxSessionsPerClient: 1})
+
+	bind := func() int {
+		req, _ := http.NewRequest("POST", "/channel/bind?VER=8&RID=1",
+			strings.NewReader("count=0"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "10.0.0.1:1234"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := bind(); code != 200 {
+		t.Fatalf("expected first session to be created, got %d", code)
+	}
+	if code := bind(); code != 503 {
+		t.Fatalf("expected second session to be refused, got %d", code)
+	}
+}
+
+func TestHandlerReleasesSessionsAfterShutdown(t *testing.T) {
+	h := NewHandler(func(c *Channel) {})
+	h.Shutdown()
+
+	request := &RequestInfo{ClientKey: "10.0.0.1"}
+	if channel, err := h.createChannel("8", request); err != errShutdown || channel != nil {
+		t.Fatalf("expected %v, got %v", errShutdown, err)
+	}
+	if sessions := h.limiter.sessions; sessions != 0 {
+		t.Errorf("expected the session to be released, got %d sessions", sessions)
+	}
+}
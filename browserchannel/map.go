@@ -5,13 +5,90 @@ package browserchannel
 
 import (
 	"errors"
+	"net/url"
 )
 
 var errCapacityExceeded = errors.New("queue capacity exceeded")
 
+// The value of the type key of the maps the client failed to serialize.
+const badMapType = "_badmap"
+
 // Type of the data transmitted from the client to the server.
 type Map map[string]string
 
+// A map that was acknowledged but not delivered on the map channel, either
+// because the client failed to serialize it, in which case the Closure client
+// already called its Handler.badMapError method and sent a placeholder, or
+// because it exceeds the map limits.
+type BadMap struct {
+	// The id of the map.
+	Id int
+	// The raw keys and values of the map as found in the request body, e.g.
+	// req0_type=_badmap. Nil for the maps rejected by a MapInterceptor and
+	// for the maps received on a WebSocket.
+	Keys url.Values
+	// The reason why the map is bad.
+	Err error
+}
+
+// Receives the bad maps of a channel. The maps are acknowledged so the client
+// doesn't send them again and the channel stays open. The callback may notify
+// the client by sending an array on the channel.
+type BadMapHandler func(*Channel, *BadMap)
+
+// Limits applied to the forward channel requests and to the maps they carry.
+// Zero values mean no limit.
+type MapLimits struct {
+	// The maximum number of maps in a single request.
+	MaxMapsPerRequest int
+	// The maximum number of keys in a map.
+	MaxKeysPerMap int
+	// The maximum length of a map key, in bytes.
+	MaxKeyLength int
+	// The maximum length of a map value, in bytes.
+	MaxValueLength int
+	// The maximum size of a request body, in bytes.
+	MaxBodySize int64
+}
+
+// The limits used by default. The Closure client never sends more than 1000
+// maps in a single request.
+var DefaultMapLimits = MapLimits{
+	MaxMapsPerRequest: 1000,
+	MaxKeysPerMap:     1000,
+	MaxKeyLength:      1 << 10,
+	MaxValueLength:    1 << 20,
+	MaxBodySize:       10 << 20,
+}
+
+// Returns the maximum length of an URL encoded key value pair.
+func (l *MapLimits) maxPairLength() int {
+	if l.MaxKeyLength == 0 || l.MaxValueLength == 0 {
+		return 0
+	}
+	// Each character may be percent encoded and the key is prefixed by the
+	// map id, e.g. req12_.
+	return 3*(l.MaxKeyLength+l.MaxValueLength) + 32
+}
+
+// Returns the maximum number of key value pairs in a request body.
+func (l *MapLimits) maxPairs() int {
+	if l.MaxMapsPerRequest == 0 || l.MaxKeysPerMap == 0 {
+		return 0
+	}
+	// Account for the count and ofs parameters along with a few others.
+	return l.MaxMapsPerRequest*l.MaxKeysPerMap + 16
+}
+
+// Returns the capacity of a map queue accepting the largest request allowed by
+// the limits.
+func (l *MapLimits) queueCapacity() int {
+	if l.MaxMapsPerRequest > defaultMapQueueCapacity {
+		return l.MaxMapsPerRequest
+	}
+	return defaultMapQueueCapacity
+}
+
 type mapQueue struct {
 	next     int
 	maps     map[int]Map
@@ -23,6 +100,12 @@ func newMapQueue(capacity int) *mapQueue {
 }
 
 func (q *mapQueue) enqueue(offset int, maps []Map) (err error) {
+	// The id of the next map is unknown until the first maps are received
+	// when the session was restored.
+	if q.next < 0 {
+		q.next = offset
+	}
+
 	if offset < q.next {
 		return
 	}
@@ -41,6 +124,12 @@ func (q *mapQueue) enqueue(offset int, maps []Map) (err error) {
 	return
 }
 
+// Checks whether the map with the given id was already received.
+func (q *mapQueue) received(id int) bool {
+	_, ok := q.maps[id]
+	return ok || id < q.next
+}
+
 func (q *mapQueue) dequeue() (m Map, ok bool) {
 	if m, ok = q.maps[q.next]; ok {
 		delete(q.maps, q.next)
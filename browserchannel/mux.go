@@ -0,0 +1,86 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Normalizes a prefix to a path starting with a slash and without a trailing
+// slash. The root prefix is normalized to an empty string.
+func cleanPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if len(prefix) == 0 {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// Serves several independent browser channel services, each with its own
+// ChannelHandler and settings, mounted under different prefixes. Requests are
+// routed to the handler with the longest matching prefix.
+type Mux struct {
+	lock     sync.RWMutex
+	handlers []*Handler
+}
+
+func NewMux() *Mux {
+	return &Mux{}
+}
+
+// Mounts the handler under the prefix, e.g. "/chat" to serve /chat/bind and
+// /chat/test. The handler's prefix is set accordingly, see Handler.SetPrefix.
+// A handler already mounted under the same prefix is replaced.
+func (m *Mux) Handle(prefix string, h *Handler) {
+	h.SetPrefix(prefix)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for i, mounted := range m.handlers {
+		if mounted.prefix == h.prefix {
+			m.handlers[i] = h
+			return
+		}
+	}
+	m.handlers = append(m.handlers, h)
+	sort.Slice(m.handlers, func(i, j int) bool {
+		return len(m.handlers[i].prefix) > len(m.handlers[j].prefix)
+	})
+}
+
+// Returns the handler mounted under the longest prefix of the path.
+func (m *Mux) match(path string) *Handler {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, h := range m.handlers {
+		if strings.HasPrefix(path, h.prefix+"/") {
+			return h
+		}
+	}
+	return nil
+}
+
+func (m *Mux) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if h := m.match(req.URL.Path); h != nil {
+		h.ServeHTTP(rw, req)
+	} else {
+		rw.WriteHeader(404)
+	}
+}
+
+// Shuts down all the mounted handlers. See Handler.Shutdown.
+func (m *Mux) Shutdown() {
+	m.lock.RLock()
+	handlers := append([]*Handler(nil), m.handlers...)
+	m.lock.RUnlock()
+
+	for _, h := range handlers {
+		h.Shutdown()
+	}
+}
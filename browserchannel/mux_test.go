@@ -0,0 +1,60 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMux(t *testing.T) {
+	mux := NewMux()
+	chat := NewHandler(func(*Channel) {})
+	chatAdmin := NewHandler(func(*Channel) {})
+	root := NewHandler(func(*Channel) {})
+	mux.Handle("/chat", chat)
+	mux.Handle("/chat/admin/", chatAdmin)
+	mux.Handle("/", root)
+
+	tests := []struct {
+		path     string
+		expected *Handler
+	}{
+		{"/chat/bind", chat},
+		{"/chat/admin/bind", chatAdmin},
+		{"/chat/administration/bind", chat},
+		{"/chatroom/bind", root},
+		{"/bind", root},
+	}
+	for _, tc := range tests {
+		if h := mux.match(tc.path); h != tc.expected {
+			t.Errorf("%s: expected handler %q, got %v", tc.path, tc.expected.prefix, h)
+		}
+	}
+
+	// The handlers only serve their own paths.
+	codes := []struct {
+		path string
+		code int
+	}{
+		{"/chat/test?VER=8&MODE=init", 200},
+		{"/chat/admin/test?VER=8&MODE=init", 200},
+		{"/chat/administration/test?VER=8&MODE=init", 404},
+		{"/chat/contest?VER=8&MODE=init", 404},
+	}
+	for _, tc := range codes {
+		rw := httptest.NewRecorder()
+		mux.ServeHTTP(rw, httptest.NewRequest("GET", tc.path, nil))
+		if rw.Code != tc.code {
+			t.Errorf("%s: expected status %d, got %d", tc.path, tc.code, rw.Code)
+		}
+	}
+
+	// Mounting a handler under the same prefix replaces the old one.
+	replacement := NewHandler(func(*Channel) {})
+	mux.Handle("chat", replacement)
+	if h := mux.match("/chat/bind"); h != replacement {
+		t.Errorf("expected the replacement handler, got %v", h)
+	}
+}
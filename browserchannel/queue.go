@@ -0,0 +1,142 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"errors"
+)
+
+var (
+	ErrQueueFull = errors.New("outgoing queue full")
+)
+
+// The policy applied when an array would exceed the outgoing queue limits.
+type QueuePolicy int
+
+const (
+	// Reject the array, in which case SendArray returns ErrQueueFull.
+	RejectWhenFull QueuePolicy = iota
+	// Drop the oldest droppable arrays to make room for the new array. The
+	// array is rejected if dropping all droppable arrays isn't enough.
+	DropOldest
+	// Close the channel.
+	CloseWhenFull
+)
+
+// Limits of the queue holding the arrays that weren't acknowledged by the
+// client. Zero values mean no limit.
+type QueueLimits struct {
+	// The maximum number of queued arrays.
+	MaxArrays int
+	// The maximum size of the queued arrays, in bytes.
+	MaxBytes int
+	// The policy applied when the limits are reached.
+	Policy QueuePolicy
+}
+
+// Options controlling how an array is queued. See Channel.SendArrayWithOptions.
+type SendOptions struct {
+	// Droppable arrays may be discarded to make room for new arrays when the
+	// outgoing queue is full and the DropOldest policy is in effect.
+	Droppable bool
+	// When not empty, any queued array with the same key is replaced by the
+	// new array, e.g. for position updates where only the latest one matters.
+	Key string
+}
+
+func (l *QueueLimits) exceeded(arrays int, bytes int) bool {
+	return (l.MaxArrays > 0 && arrays > l.MaxArrays) ||
+		(l.MaxBytes > 0 && bytes > l.MaxBytes)
+}
+
+// Returns the index of the first array that wasn't sent on the current back
+// channel.
+func (c *Channel) firstUnsentArray() int {
+	for i, a := range c.outgoingArrays {
+		if a.index > c.lastSentArrayId {
+			return i
+		}
+	}
+	return len(c.outgoingArrays)
+}
+
+// Removes the outgoing array at the given index.
+func (c *Channel) removeArray(i int) {
+	last := len(c.outgoingArrays) - 1
+	c.outgoingBytes -= len(c.outgoingArrays[i].data)
+	id := c.outgoingArrays[i].index
+	c.queueStoreOp(func(store OutgoingStore) {
+		if err := store.Delete(c.Sid, id); err != nil {
+			c.log("store delete %d: %s", id, err)
+		}
+	})
+	copy(c.outgoingArrays[i:], c.outgoingArrays[i+1:])
+	c.outgoingArrays[last] = nil
+	c.outgoingArrays = c.outgoingArrays[:last]
+}
+
+// Removes the queued arrays having the given key.
+func (c *Channel) replaceArrays(key string) {
+	for i := 0; i < len(c.outgoingArrays); {
+		if c.outgoingArrays[i].key == key {
+			c.removeArray(i)
+		} else {
+			i++
+		}
+	}
+}
+
+// Returns the number and the size of the queued arrays having the given key.
+func (c *Channel) keyedArrays(key string) (count int, size int) {
+	if len(key) == 0 {
+		return
+	}
+	for _, a := range c.outgoingArrays {
+		if a.key == key {
+			count++
+			size += len(a.data)
+		}
+	}
+	return
+}
+
+// Makes room in the outgoing queue for an array of the given size and key
+// according to the queue policy, not counting the queued arrays the new array
+// replaces. Returns ErrQueueFull if the array can't be queued, in which case
+// the arrays it would have replaced are kept.
+func (c *Channel) makeRoom(size int, key string) (err error) {
+	limits := &c.settings.queueLimits
+	replacedCount, replacedSize := c.keyedArrays(key)
+	exceeded := func() bool {
+		return limits.exceeded(len(c.outgoingArrays)-replacedCount+1,
+			c.outgoingBytes-replacedSize+size)
+	}
+
+	if !exceeded() {
+		return
+	}
+
+	switch limits.Policy {
+	case DropOldest:
+		for i := 0; i < len(c.outgoingArrays) && exceeded(); {
+			if a := c.outgoingArrays[i]; a.droppable && (len(key) == 0 || a.key != key) {
+				c.log("drop array %d", a.index)
+				c.removeArray(i)
+			} else {
+				i++
+			}
+		}
+		if exceeded() {
+			err = ErrQueueFull
+		}
+	case CloseWhenFull:
+		c.log("outgoing queue full")
+		c.closeInternal(CloseServerClosed, "outgoing queue full")
+		err = ErrQueueFull
+	default:
+		err = ErrQueueFull
+	}
+
+	return
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"testing"
+)
+
+// Returns the indexes of the queued outgoing arrays.
+func queuedIndexes(c *Channel) (indexes []int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, a := range c.outgoingArrays {
+		indexes = append(indexes, a.index)
+	}
+	return
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestQueueReject(t *testing.T) {
+	c, _ := newTestChannel(channelSettings{
+		queueLimits: QueueLimits{MaxArrays: 3, Policy: RejectWhenFull},
+	})
+	defer c.terminate(CloseClientTerminated)
+
+	// The channel configuration array is the first queued array.
+	c.SendArray(Array{"a"})
+	c.SendArray(Array{"b"})
+
+	if err := c.SendArray(Array{"c"}); err != ErrQueueFull {
+		t.Fatalf("expected %v, got %v", ErrQueueFull, err)
+	}
+
+	// Acknowledging arrays makes room for new ones.
+	c.acknowledgeArrays(2)
+
+	if err := c.SendArray(Array{"c"}); err != nil {
+		t.Fatalf("expected array to be queued, got %v", err)
+	}
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	c, _ := newTestChannel(channelSettings{
+		queueLimits: QueueLimits{MaxBytes: 30, Policy: DropOldest},
+	})
+	defer c.terminate(CloseClientTerminated)
+
+	c.acknowledgeArrays(1)
+
+	droppable := SendOptions{Droppable: true}
+	c.SendArrayWithOptions(Array{"aaaaaaaa"}, droppable) // 2
+	c.SendArray(Array{"bbbbbbbb"})                       // 3
+	c.SendArrayWithOptions(Array{"cccccccc"}, droppable) // 4
+
+	if expected, actual := []int{3, 4}, queuedIndexes(c); !equalInts(expected, actual) {
+		t.Fatalf("expected %v to be queued, got %v", expected, actual)
+	}
+
+	// The non droppable array can't be dropped to make room.
+	if err := c.SendArray(Array{"dddddddddddddddddddddd"}); err != ErrQueueFull {
+		t.Fatalf("expected %v, got %v", ErrQueueFull, err)
+	}
+}
+
+func TestQueueCloseWhenFull(t *testing.T) {
+	c, bc := newTestChannel(channelSettings{
+		queueLimits: QueueLimits{MaxArrays: 2, Policy: CloseWhenFull},
+	})
+
+	c.SendArray(Array{"a"})
+
+	if err := c.SendArray(Array{"b"}); err != ErrQueueFull {
+		t.Fatalf("expected %v, got %v", ErrQueueFull, err)
+	}
+
+	chunks := bc.getChunks()
+	if len(chunks) != 2 || chunks[1] != `[[3,["stop",3,"outgoing queue full"]]]` {
+		t.Fatalf("expected stop array to be sent, got %v", chunks)
+	}
+
+	if err := c.SendArray(Array{"c"}); err != ErrClosed {
+		t.Fatalf("expected %v, got %v", ErrClosed, err)
+	}
+}
+
+func TestQueueReplaceKey(t *testing.T) {
+	c, bc := newTestChannel(channelSettings{})
+	defer c.terminate(CloseClientTerminated)
+
+	c.removeBackChannel(bc)
+
+	position := SendOptions{Key: "position"}
+	c.SendArrayWithOptions(Array{"position", 1}, position) // 2
+	c.SendArray(Array{"message"})                          // 3
+	c.SendArrayWithOptions(Array{"position", 2}, position) // 4
+
+	if expected, actual := []int{1, 3, 4}, queuedIndexes(c); !equalInts(expected, actual) {
+		t.Fatalf("expected %v to be queued, got %v", expected, actual)
+	}
+
+	bc = &fakeBackChannel{}
+	c.setBackChannel(bc)
+
+	expected := []string{`[[1,["c","00000000000000000000000000000000","",8]],` +
+		`[3,["message"]],[4,["position",2]]]`}
+	if chunks := bc.getChunks(); !equalStrings(chunks, expected) {
+		t.Errorf("expected %v, got %v", expected, chunks)
+	}
+}
+
+func TestQueueReplaceKeyWhenFull(t *testing.T) {
+	c, bc := newTestChannel(channelSettings{
+		queueLimits: QueueLimits{MaxBytes: 30, Policy: RejectWhenFull},
+	})
+	defer c.terminate(CloseClientTerminated)
+
+	c.removeBackChannel(bc)
+	c.acknowledgeArrays(1)
+
+	position := SendOptions{Key: "position"}
+	c.SendArrayWithOptions(Array{"position", 1}, position) // 2
+	c.SendArray(Array{"message"})                          // 3
+
+	// The replaced array doesn't count against the limits.
+	if err := c.SendArrayWithOptions(Array{"position", 2}, position); err != nil {
+		t.Fatalf("expected array to replace the queued one, got %v", err)
+	}
+	if expected, actual := []int{3, 4}, queuedIndexes(c); !equalInts(expected, actual) {
+		t.Fatalf("expected %v to be queued, got %v", expected, actual)
+	}
+
+	// The replaced array is kept when the new one is rejected.
+	if err := c.SendArrayWithOptions(Array{"position", "far too long to fit"}, position); err != ErrQueueFull {
+		t.Fatalf("expected %v, got %v", ErrQueueFull, err)
+	}
+	if expected, actual := []int{3, 4}, queuedIndexes(c); !equalInts(expected, actual) {
+		t.Fatalf("expected %v to be queued, got %v", expected, actual)
+	}
+}
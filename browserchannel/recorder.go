@@ -0,0 +1,222 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Possible values of the Record type.
+const (
+	// A test or bind request.
+	RecordRequest = "request"
+	// The data flushed on a response, e.g. a back channel chunk.
+	RecordChunk = "chunk"
+	// The end of a response.
+	RecordEnd = "end"
+)
+
+// An entry of a recording, see Recorder. The records of a request share the
+// same id.
+type Record struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	Id   int64     `json:"id"`
+	// The session id seen by the client. Empty for the test requests and for
+	// the initial bind requests that didn't create a session.
+	Sid string `json:"sid,omitempty"`
+	// The request method, URL, headers and body.
+	Method string      `json:"method,omitempty"`
+	URL    string      `json:"url,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+	// The response status, on the end records.
+	Status int `json:"status,omitempty"`
+	// The response data of the chunk and end records.
+	Data string `json:"data,omitempty"`
+}
+
+// The request headers that aren't recorded.
+var unrecordedHeaders = []string{"Authorization", "Cookie"}
+
+// Records the test and bind requests served by a handler along with the data
+// of their responses, as JSON records separated by new lines. See
+// Handler.SetRecorder and Replay.
+type Recorder struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+	next int64
+	err  error
+}
+
+// Creates a recorder writing the records to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+func (r *Recorder) write(record *Record) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// Only the first error is logged to avoid flooding the log.
+	if err := r.enc.Encode(record); err != nil && r.err == nil {
+		log.Printf("recorder: %s\n", err)
+		r.err = err
+	}
+}
+
+// Starts recording a request. The request body is recorded as it is read.
+func (r *Recorder) begin(rw http.ResponseWriter, req *http.Request) *recordingResponseWriter {
+	r.lock.Lock()
+	r.next++
+	id := r.next
+	r.lock.Unlock()
+
+	header := req.Header.Clone()
+	for _, name := range unrecordedHeaders {
+		header.Del(name)
+	}
+
+	w := &recordingResponseWriter{
+		ResponseWriter: rw,
+		recorder:       r,
+		id:             id,
+		sid:            req.URL.Query().Get("SID"),
+		request: &Record{
+			Time:   time.Now(),
+			Type:   RecordRequest,
+			Method: req.Method,
+			URL:    req.URL.RequestURI(),
+			Header: header,
+		},
+	}
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(req.Body, &w.body), req.Body}
+	return w
+}
+
+// Records the data written on a response. The request record is written once
+// the response starts, so it carries the sid of the session created by the
+// request.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	recorder *Recorder
+	id       int64
+	sid      string
+	// The request record, until it is written.
+	request *Record
+	body    bytes.Buffer
+	status  int
+	data    bytes.Buffer
+	// Whether the response is compressed, in which case the uncompressed
+	// data is recorded by recordUncompressed instead of the written data.
+	compressed bool
+}
+
+func (w *recordingResponseWriter) start() {
+	if w.request != nil {
+		w.request.Id = w.id
+		w.request.Sid = w.sid
+		w.request.Body = w.body.String()
+		w.recorder.write(w.request)
+		w.request = nil
+	}
+}
+
+func (w *recordingResponseWriter) record(recordType string) {
+	w.start()
+	record := &Record{Time: time.Now(), Type: recordType, Id: w.id, Sid: w.sid, Data: w.data.String()}
+	if recordType == RecordEnd {
+		record.Status = w.status
+	}
+	w.recorder.write(record)
+	w.data.Reset()
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	if !w.compressed {
+		w.data.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Records the data of a compressed response before it is compressed, so the
+// recorded chunks are the arrays seen by the clients.
+func (w *recordingResponseWriter) recordUncompressed(data []byte) {
+	w.compressed = true
+	w.data.Write(data)
+}
+
+// Records the data written since the last flush as a chunk. See
+// http.ResponseController.
+func (w *recordingResponseWriter) FlushError() error {
+	if w.data.Len() > 0 {
+		w.record(RecordChunk)
+	}
+	return flush(w.ResponseWriter)
+}
+
+func (w *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *recordingResponseWriter) end() {
+	if w.status == 0 {
+		w.status = 200
+	}
+	w.record(RecordEnd)
+}
+
+// Tags the records of the response with the sid of the session created by the
+// request.
+func setRecordedSid(rw http.ResponseWriter, sid string) {
+	if w, ok := rw.(*recordingResponseWriter); ok && w.request != nil {
+		w.sid = sid
+	}
+}
+
+// Sets the recorder of the test and bind requests. The chunks of the
+// compressed back channels are recorded uncompressed, as seen by the clients.
+// The Authorization and Cookie headers aren't recorded. WebSocket connections
+// aren't recorded.
+func (h *Handler) SetRecorder(recorder *Recorder) {
+	h.recorder = recorder
+}
+
+// Reads the records of a recording.
+func ReadRecording(r io.Reader) (records []*Record, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		record := new(Record)
+		if err = json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return
+		}
+		records = append(records, record)
+	}
+	err = scanner.Err()
+	return
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Starts a server echoing the maps received on its channels, transformed by f.
+func startEchoServer(f func(string) string, recorder *Recorder) *httptest.Server {
+	h := NewHandler(func(c *Channel) {
+		for m := range c.Maps() {
+			c.SendArray(Array{f(m["text"])})
+		}
+	})
+	if recorder != nil {
+		h.SetRecorder(recorder)
+	}
+	return httptest.NewServer(h)
+}
+
+func get(t *testing.T, client *http.Client, url string, body string) string {
+	method := "GET"
+	if len(body) > 0 {
+		method = "POST"
+	}
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return string(data)
+}
+
+// Records a session exchanging a single map.
+func recordSession(t *testing.T) (records []*Record, sid string) {
+	var recording bytes.Buffer
+	server := startEchoServer(strings.ToUpper, NewRecorder(&recording))
+	defer server.Close()
+
+	// The requests are spaced so their replay happens in the same order.
+	client := server.Client()
+	base := server.URL + "/channel/"
+	get(t, client, base+"test?VER=8&MODE=init&zx=a&t=1", "")
+	time.Sleep(50 * time.Millisecond)
+	match := sidArrayRegexp.FindStringSubmatch(get(t, client, base+"bind?VER=8&CVER=8&RID=1&zx=b&t=1", "count=0"))
+	if match == nil {
+		t.Fatal("expected the 'c' array")
+	}
+	sid = match[1]
+	time.Sleep(50 * time.Millisecond)
+	get(t, client, base+"bind?VER=8&SID="+sid+"&RID=2&AID=1&zx=c&t=1", "count=1&ofs=0&req0_text=hello")
+	time.Sleep(50 * time.Millisecond)
+	get(t, client, base+"bind?VER=8&SID="+sid+"&RID=rpc&AID=1&CI=1&TYPE=xmlhttp&zx=d&t=1", "")
+
+	records, err := ReadRecording(&recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestRecorder(t *testing.T) {
+	records, sid := recordSession(t)
+
+	expected := []struct {
+		recordType string
+		id         int64
+		sid        string
+		status     int
+		data       string
+	}{
+		{RecordRequest, 1, "", 0, ""},
+		{RecordEnd, 1, "", 200, `["",""]`},
+		{RecordRequest, 2, sid, 0, ""},
+		{RecordChunk, 2, sid, 0, "51\n" + `[[1,["c","` + sid + `","",8]]]`},
+		{RecordEnd, 2, sid, 200, ""},
+		{RecordRequest, 3, sid, 0, ""},
+		{RecordEnd, 3, sid, 200, "7\n[0,1,0]"},
+		{RecordRequest, 4, sid, 0, ""},
+		{RecordChunk, 4, sid, 0, "15\n[[2,[\"HELLO\"]]]"},
+		{RecordEnd, 4, sid, 200, ""},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("expected %d records, got %d", len(expected), len(records))
+	}
+	for i, e := range expected {
+		r := records[i]
+		if r.Type != e.recordType || r.Id != e.id || r.Sid != e.sid || r.Status != e.status || r.Data != e.data {
+			t.Errorf("record %d: expected %+v, got %+v", i, e, r)
+		}
+	}
+
+	if body := records[5].Body; body != "count=1&ofs=0&req0_text=hello" {
+		t.Errorf("expected the forward channel body, got %q", body)
+	}
+	if records[5].Method != "POST" || !strings.HasPrefix(records[5].URL, "/channel/bind?") {
+		t.Errorf("expected the forward channel request, got %s %s", records[5].Method, records[5].URL)
+	}
+}
+
+func TestRecorderCompressed(t *testing.T) {
+	var recording bytes.Buffer
+	h := NewHandler(func(c *Channel) {
+		for m := range c.Maps() {
+			c.SendArray(Array{m["text"]})
+		}
+	})
+	h.SetCompression(true)
+	h.SetRecorder(NewRecorder(&recording))
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	client := server.Client()
+	base := server.URL + "/channel/"
+	match := sidArrayRegexp.FindStringSubmatch(get(t, client, base+"bind?VER=8&CVER=8&RID=1&zx=b&t=1", "count=0"))
+	if match == nil {
+		t.Fatal("expected the 'c' array")
+	}
+	sid := match[1]
+	get(t, client, base+"bind?VER=8&SID="+sid+"&RID=2&AID=1&zx=c&t=1", "count=1&ofs=0&req0_text=hello")
+
+	resp, err := client.Get(base + "bind?VER=8&SID=" + sid + "&RID=rpc&AID=1&CI=1&TYPE=xmlhttp&zx=d&t=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !resp.Uncompressed || string(data) != "15\n[[2,[\"hello\"]]]" {
+		t.Fatalf("expected a compressed back channel, got %q (uncompressed: %v)", data, resp.Uncompressed)
+	}
+
+	records, err := ReadRecording(&recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks []string
+	for _, r := range records {
+		if r.Type == RecordChunk {
+			chunks = append(chunks, r.Data)
+		}
+		if strings.HasPrefix(r.Data, "\x1f\x8b") {
+			t.Errorf("expected uncompressed data, got %q", r.Data)
+		}
+	}
+	expected := []string{"51\n" + `[[1,["c","` + sid + `","",8]]]`, "15\n[[2,[\"hello\"]]]"}
+	if !equalStrings(chunks, expected) {
+		t.Errorf("expected chunks %q, got %q", expected, chunks)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	records, _ := recordSession(t)
+	opts := ReplayOptions{Grace: time.Second}
+
+	server := startEchoServer(strings.ToUpper, nil)
+	defer server.Close()
+	mismatches, err := Replay(records, server.URL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mismatches {
+		t.Errorf("unexpected mismatch %s", m)
+	}
+
+	// A server that behaves differently is caught.
+	other := startEchoServer(strings.ToLower, nil)
+	defer other.Close()
+	mismatches, err = Replay(records, other.URL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 1 || mismatches[0].Id != 4 || mismatches[0].Actual != "15\n[[2,[\"hello\"]]]" {
+		t.Errorf("expected the back channel to mismatch, got %v", mismatches)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errUnresolvedSession = errors.New("session wasn't created during the replay")
+
+// The delay given to the responses after their recorded duration before their
+// replay is cancelled, by default.
+const DefaultReplayGrace = 5 * time.Second
+
+// Matches the session id of the 'c' array.
+var sidArrayRegexp = regexp.MustCompile(`\["c","([^"]+)"`)
+
+// The options of Replay.
+type ReplayOptions struct {
+	// The client sending the requests, http.DefaultClient when nil.
+	Client *http.Client
+	// The speed of the replay relative to the recording, e.g. 2 to replay the
+	// requests twice as fast. Defaults to 1.
+	Speed float64
+	// The delay given to the responses after their recorded duration before
+	// they're cancelled. Defaults to DefaultReplayGrace.
+	Grace time.Duration
+}
+
+// A replayed response that didn't match the recorded one.
+type ReplayMismatch struct {
+	// The id of the recorded request.
+	Id int64
+	// The recorded session id.
+	Sid    string
+	Method string
+	URL    string
+	// The recorded status and data.
+	ExpectedStatus int
+	Expected       string
+	// The replayed status and data.
+	Status int
+	Actual string
+	// The error that prevented the request from being replayed, if any.
+	Err error
+}
+
+func (m *ReplayMismatch) String() string {
+	if m.Err != nil {
+		return fmt.Sprintf("#%d %s %s: %s", m.Id, m.Method, m.URL, m.Err)
+	}
+	return fmt.Sprintf("#%d %s %s: expected %d %q, got %d %q", m.Id, m.Method, m.URL,
+		m.ExpectedStatus, m.Expected, m.Status, m.Actual)
+}
+
+// A recorded request and its response.
+type exchange struct {
+	request  *Record
+	sid      string
+	status   int
+	data     strings.Builder
+	duration time.Duration
+	// Whether the end of the response was recorded.
+	complete bool
+}
+
+// Groups the records by request, in the order the requests were made.
+func groupExchanges(records []*Record) (exchanges []*exchange) {
+	byId := make(map[int64]*exchange)
+	for _, r := range records {
+		e := byId[r.Id]
+		if r.Type == RecordRequest {
+			e = &exchange{request: r, sid: r.Sid}
+			byId[r.Id] = e
+			exchanges = append(exchanges, e)
+			continue
+		} else if e == nil {
+			continue
+		}
+
+		e.data.WriteString(r.Data)
+		e.duration = r.Time.Sub(e.request.Time)
+		if r.Type == RecordEnd {
+			e.status = r.Status
+			e.complete = true
+		}
+	}
+
+	sort.SliceStable(exchanges, func(i, j int) bool {
+		return exchanges[i].request.Time.Before(exchanges[j].request.Time)
+	})
+	return
+}
+
+// A session id learned during the replay.
+type replayedSid struct {
+	ready chan struct{}
+	sid   string
+}
+
+// Maps the recorded session ids to the session ids of the replay.
+type replayedSids struct {
+	lock sync.Mutex
+	m    map[string]*replayedSid
+}
+
+func (s *replayedSids) get(recorded string) *replayedSid {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r, ok := s.m[recorded]
+	if !ok {
+		r = &replayedSid{ready: make(chan struct{})}
+		s.m[recorded] = r
+	}
+	return r
+}
+
+func (s *replayedSids) resolve(recorded, sid string) {
+	r := s.get(recorded)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-r.ready:
+	default:
+		r.sid = sid
+		close(r.ready)
+	}
+}
+
+// Replays the recorded test and bind requests against the server at baseURL,
+// e.g. "http://localhost:8080", preserving their timing. The session ids of
+// the recording are replaced by the ones of the sessions created during the
+// replay. Returns the responses that didn't match the recording, ordered by
+// request id. Responses that weren't fully recorded only need to start with
+// the recorded data. See Recorder.
+func Replay(records []*Record, baseURL string, opts ReplayOptions) (mismatches []*ReplayMismatch, err error) {
+	if _, err = url.Parse(baseURL); err != nil {
+		return
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.Speed <= 0 {
+		opts.Speed = 1
+	}
+	if opts.Grace <= 0 {
+		opts.Grace = DefaultReplayGrace
+	}
+
+	exchanges := groupExchanges(records)
+	if len(exchanges) == 0 {
+		return
+	}
+
+	sids := &replayedSids{m: make(map[string]*replayedSid)}
+	first := exchanges[0].request.Time
+	start := time.Now()
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, e := range exchanges {
+		wg.Add(1)
+		go func(e *exchange) {
+			defer wg.Done()
+
+			offset := time.Duration(float64(e.request.Time.Sub(first)) / opts.Speed)
+			time.Sleep(time.Until(start.Add(offset)))
+
+			if m := replayExchange(e, baseURL, sids, &opts); m != nil {
+				lock.Lock()
+				mismatches = append(mismatches, m)
+				lock.Unlock()
+			}
+		}(e)
+	}
+	wg.Wait()
+
+	sort.Slice(mismatches, func(i, j int) bool {
+		return mismatches[i].Id < mismatches[j].Id
+	})
+	return
+}
+
+func replayExchange(e *exchange, baseURL string, sids *replayedSids, opts *ReplayOptions) *ReplayMismatch {
+	r := e.request
+	mismatch := &ReplayMismatch{Id: r.Id, Sid: e.sid, Method: r.Method, URL: r.URL,
+		ExpectedStatus: e.status, Expected: e.data.String()}
+
+	duration := time.Duration(float64(e.duration)/opts.Speed) + opts.Grace
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	u, err := url.Parse(baseURL + r.URL)
+	if err != nil {
+		mismatch.Err = err
+		return mismatch
+	}
+
+	// The requests of a session wait for the request creating it.
+	query := u.Query()
+	creator := len(e.sid) > 0 && len(query.Get("SID")) == 0
+	sid := ""
+	if len(e.sid) > 0 && !creator {
+		replayed := sids.get(e.sid)
+		select {
+		case <-replayed.ready:
+		case <-ctx.Done():
+			mismatch.Err = errUnresolvedSession
+			return mismatch
+		}
+		if sid = replayed.sid; len(sid) == 0 {
+			mismatch.Err = errUnresolvedSession
+			return mismatch
+		}
+		query.Set("SID", sid)
+		u.RawQuery = query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.Method, u.String(), strings.NewReader(r.Body))
+	if err != nil {
+		mismatch.Err = err
+		return mismatch
+	}
+	for name, values := range r.Header {
+		if name != "Accept-Encoding" && name != "Content-Length" {
+			req.Header[name] = values
+		}
+	}
+
+	resp, err := opts.Client.Do(req)
+	if err != nil {
+		if creator {
+			sids.resolve(e.sid, "")
+		}
+		mismatch.Err = err
+		return mismatch
+	}
+	defer resp.Body.Close()
+
+	// The responses that last longer than recorded are cut short.
+	data, err := io.ReadAll(resp.Body)
+	if err != nil && ctx.Err() == nil {
+		mismatch.Err = err
+		return mismatch
+	}
+	actual := string(data)
+
+	if creator {
+		sid = resp.Header.Get(webChannelSessionIdHeader)
+		if match := sidArrayRegexp.FindStringSubmatch(actual); len(sid) == 0 && match != nil {
+			sid = match[1]
+		}
+		sids.resolve(e.sid, sid)
+	}
+	if len(sid) > 0 {
+		actual = strings.Replace(actual, sid, e.sid, -1)
+	}
+
+	expected := e.data.String()
+	if e.complete && (resp.StatusCode != e.status || actual != expected) ||
+		!e.complete && !strings.HasPrefix(actual, expected) {
+		mismatch.Status = resp.StatusCode
+		mismatch.Actual = actual
+		return mismatch
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var errBadVersionRange = errors.New("bad version range")
+
+// The message of the stop array sent to the clients whose version isn't
+// supported by default.
+const DefaultUnsupportedVersionMessage = "unsupported client version"
+
+// A semantic version, see http://semver.org. Missing minor and patch numbers
+// are zero.
+type semver struct {
+	parts      [3]int
+	prerelease []string
+	// The number of version numbers that were specified.
+	specified int
+}
+
+func parseSemver(s string) (v semver, err error) {
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.prerelease = strings.Split(s[i+1:], ".")
+		s = s[:i]
+	}
+
+	numbers := strings.Split(s, ".")
+	if len(numbers) > 3 {
+		return v, errBadVersionRange
+	}
+	for i, n := range numbers {
+		if v.parts[i], err = strconv.Atoi(n); err != nil || v.parts[i] < 0 {
+			return v, errBadVersionRange
+		}
+	}
+	v.specified = len(numbers)
+	return
+}
+
+// Compares two pre-release identifiers, numerically when both are numbers.
+func compareIdentifiers(a, b string) int {
+	na, erra := strconv.Atoi(a)
+	nb, errb := strconv.Atoi(b)
+	switch {
+	case erra == nil && errb == nil:
+		return na - nb
+	case erra == nil:
+		return -1
+	case errb == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// Returns a negative number, zero or a positive number when v is lower, equal
+// or greater than o. A pre-release version is lower than the release.
+func (v semver) compare(o semver) int {
+	for i := range v.parts {
+		if d := v.parts[i] - o.parts[i]; d != 0 {
+			return d
+		}
+	}
+	if len(v.prerelease) == 0 || len(o.prerelease) == 0 {
+		return len(o.prerelease) - len(v.prerelease)
+	}
+	for i := 0; i < len(v.prerelease) && i < len(o.prerelease); i++ {
+		if d := compareIdentifiers(v.prerelease[i], o.prerelease[i]); d != 0 {
+			return d
+		}
+	}
+	return len(v.prerelease) - len(o.prerelease)
+}
+
+// Returns the lowest version greater than all the versions matching the
+// specified numbers up to the given index, e.g. 1.3.0 for 1.2 and index 1.
+func (v semver) bump(index int) (next semver) {
+	next.parts[index] = v.parts[index] + 1
+	for i := 0; i < index; i++ {
+		next.parts[i] = v.parts[i]
+	}
+	// The pre-releases of the next version are excluded.
+	next.prerelease = []string{"0"}
+	return
+}
+
+// Matches a version against a bound.
+type comparator struct {
+	op      string
+	version semver
+}
+
+func (c comparator) match(v semver) bool {
+	d := v.compare(c.version)
+	switch c.op {
+	case "<":
+		return d < 0
+	case "<=":
+		return d <= 0
+	case ">":
+		return d > 0
+	case ">=":
+		return d >= 0
+	}
+	return d == 0
+}
+
+// A set of alternatives, each of them matching the versions satisfying all its
+// comparators.
+type versionRange [][]comparator
+
+// Parses a range made of alternatives separated by ||, each of them made of
+// space separated comparators: =, <, <=, >, >=, ^ (compatible with) or ~
+// (approximately), e.g. ">=1.2.0 <1.5.0 || ^2.1".
+func parseVersionRange(s string) (r versionRange, err error) {
+	for _, alternative := range strings.Split(s, "||") {
+		var comparators []comparator
+		for _, field := range strings.Fields(alternative) {
+			var parsed []comparator
+			if parsed, err = parseComparator(field); err != nil {
+				return nil, err
+			}
+			comparators = append(comparators, parsed...)
+		}
+		if len(comparators) == 0 {
+			return nil, errBadVersionRange
+		}
+		r = append(r, comparators)
+	}
+	return
+}
+
+func parseComparator(s string) (comparators []comparator, err error) {
+	version := strings.TrimLeft(s, "<>=^~")
+	op := s[:len(s)-len(version)]
+	v, err := parseSemver(version)
+	if err != nil {
+		return
+	}
+
+	switch op {
+	case "^":
+		// Allows the changes that don't modify the left-most non-zero
+		// specified number.
+		index := 0
+		for index < v.specified-1 && v.parts[index] == 0 {
+			index++
+		}
+		comparators = []comparator{{">=", v}, {"<", v.bump(index)}}
+	case "~":
+		// Allows patch level changes, or minor level changes when only the
+		// major number is specified.
+		index := 1
+		if v.specified == 1 {
+			index = 0
+		}
+		comparators = []comparator{{">=", v}, {"<", v.bump(index)}}
+	case "", "=", "<", "<=", ">", ">=":
+		comparators = []comparator{{op, v}}
+	default:
+		err = errBadVersionRange
+	}
+	return
+}
+
+func (r versionRange) match(v semver) bool {
+	for _, comparators := range r {
+		matched := true
+		for _, c := range comparators {
+			if !c.match(v) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+type versionRoute struct {
+	versionRange versionRange
+	handler      ChannelHandler
+}
+
+// Dispatches the channels to ChannelHandlers according to the client version,
+// see Channel.Version. A channel goes to the handler registered for its exact
+// version, then to the handler registered for the longest prefix of its
+// version and then to the handler of the first version range it matches, in
+// registration order. The channels that don't match any of them go to the
+// fallback handler or, when there is none, are closed with the
+// CloseUnsupportedVersion code. See Handler.SetVersionRouter.
+type VersionRouter struct {
+	lock     sync.RWMutex
+	exact    map[string]ChannelHandler
+	prefixes map[string]ChannelHandler
+	ranges   []versionRoute
+	fallback ChannelHandler
+	message  string
+}
+
+func NewVersionRouter() *VersionRouter {
+	return &VersionRouter{
+		exact:    make(map[string]ChannelHandler),
+		prefixes: make(map[string]ChannelHandler),
+		message:  DefaultUnsupportedVersionMessage,
+	}
+}
+
+// Registers the handler of the channels of the given client version.
+func (r *VersionRouter) Handle(version string, handler ChannelHandler) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.exact[version] = handler
+}
+
+// Registers the handler of the channels whose client version starts with the
+// given prefix, e.g. "2.1." or "beta-".
+func (r *VersionRouter) HandlePrefix(prefix string, handler ChannelHandler) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.prefixes[prefix] = handler
+}
+
+// Registers the handler of the channels whose client version is a semantic
+// version matching the range, e.g. ">=1.2.0 <1.5.0 || ^2.1". The supported
+// operators are =, <, <=, >, >=, ^ and ~, with the npm semantics.
+func (r *VersionRouter) HandleRange(versionRange string, handler ChannelHandler) (err error) {
+	parsed, err := parseVersionRange(versionRange)
+	if err != nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.ranges = append(r.ranges, versionRoute{parsed, handler})
+	return
+}
+
+// Sets the handler of the channels whose client version doesn't match any of
+// the registered versions.
+func (r *VersionRouter) HandleFallback(handler ChannelHandler) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.fallback = handler
+}
+
+// Sets the message of the stop array closing the channels whose client
+// version isn't supported, which can be used by the client to tell the user
+// to upgrade. Defaults to DefaultUnsupportedVersionMessage. Only used when
+// there is no fallback handler.
+func (r *VersionRouter) SetUnsupportedVersionMessage(message string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.message = message
+}
+
+// Returns the handler of the client version, or nil if the version isn't
+// supported.
+func (r *VersionRouter) route(version string) ChannelHandler {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if handler, ok := r.exact[version]; ok {
+		return handler
+	}
+
+	longest := -1
+	var handler ChannelHandler
+	for prefix, h := range r.prefixes {
+		if len(prefix) > longest && strings.HasPrefix(version, prefix) {
+			longest = len(prefix)
+			handler = h
+		}
+	}
+	if handler != nil {
+		return handler
+	}
+
+	if v, err := parseSemver(version); err == nil {
+		for _, route := range r.ranges {
+			if route.versionRange.match(v) {
+				return route.handler
+			}
+		}
+	}
+	return r.fallback
+}
+
+// Hands the channel to the handler of its client version. Can be used as the
+// ChannelHandler of a Handler.
+func (r *VersionRouter) ServeChannel(channel *Channel) {
+	if handler := r.route(channel.Version); handler != nil {
+		handler(channel)
+		return
+	}
+
+	r.lock.RLock()
+	message := r.message
+	r.lock.RUnlock()
+
+	log.Printf("%s: unsupported client version %q\n", channel.Sid, channel.Version)
+	channel.CloseWithReason(CloseUnsupportedVersion, message)
+}
+
+// Dispatches the new channels according to their client version instead of
+// handing them to the handler's ChannelHandler.
+func (h *Handler) SetVersionRouter(router *VersionRouter) {
+	h.chanHandler = router.ServeChannel
+}
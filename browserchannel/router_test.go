@@ -0,0 +1,131 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"testing"
+)
+
+func TestVersionRange(t *testing.T) {
+	tests := []struct {
+		versionRange string
+		version      string
+		expected     bool
+	}{
+		{"1.2.3", "1.2.3", true},
+		{"=1.2.3", "v1.2.3", true},
+		{"1.2.3", "1.2.4", false},
+		{">=1.2.0 <1.5.0", "1.4.9", true},
+		{">=1.2.0 <1.5.0", "1.5.0", false},
+		{">=1.2.0 <1.5.0", "1.1.9", false},
+		{">1.2", "1.2.0", false},
+		{">1.2", "1.2.1", true},
+		{"<=2", "2.0.0", true},
+		{"^1.2.3", "1.9.0", true},
+		{"^1.2.3", "1.2.2", false},
+		{"^1.2.3", "2.0.0", false},
+		{"^1.2.3", "2.0.0-beta", false},
+		{"^0.2.3", "0.2.9", true},
+		{"^0.2.3", "0.3.0", false},
+		{"^0.0.3", "0.0.4", false},
+		{"^0", "0.9.0", true},
+		{"~1.2.3", "1.2.9", true},
+		{"~1.2.3", "1.3.0", false},
+		{"~1", "1.9.0", true},
+		{"~1", "2.0.0", false},
+		{"<1.0.0 || ^2.1", "0.5.0", true},
+		{"<1.0.0 || ^2.1", "2.5.0", true},
+		{"<1.0.0 || ^2.1", "1.5.0", false},
+		{">=1.0.0", "1.0.0-rc.1", false},
+		{">=1.0.0-rc.2", "1.0.0-rc.10", true},
+		{">=1.0.0-rc.2", "1.0.0-rc.1", false},
+		{">=1.0.0-alpha", "1.0.0-beta", true},
+		{"1.0.0", "1.0.0+build.5", true},
+	}
+
+	for _, tc := range tests {
+		r, err := parseVersionRange(tc.versionRange)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.versionRange, err)
+			continue
+		}
+		v, err := parseSemver(tc.version)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.version, err)
+			continue
+		}
+		if matched := r.match(v); matched != tc.expected {
+			t.Errorf("%s matching %s: expected %t, got %t", tc.versionRange, tc.version, tc.expected, matched)
+		}
+	}
+}
+
+func TestBadVersionRange(t *testing.T) {
+	for _, s := range []string{"", "||", "1.2.3 ||", "!1.2", ">>1", "1.2.3.4", "1.x", "^", "=>1"} {
+		if _, err := parseVersionRange(s); err != errBadVersionRange {
+			t.Errorf("%q: expected errBadVersionRange, got %v", s, err)
+		}
+	}
+}
+
+func TestVersionRouter(t *testing.T) {
+	var routed string
+	handler := func(name string) ChannelHandler {
+		return func(*Channel) { routed = name }
+	}
+
+	r := NewVersionRouter()
+	r.Handle("2.1.0", handler("exact"))
+	r.HandlePrefix("2.", handler("2.x"))
+	r.HandlePrefix("2.1.", handler("2.1.x"))
+	r.HandlePrefix("beta-", handler("beta"))
+	if err := r.HandleRange("^1.4", handler("1.4+")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.HandleRange(">=1.0.0", handler("1.x")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		version  string
+		expected string
+	}{
+		{"2.1.0", "exact"},
+		{"2.1.3", "2.1.x"},
+		{"2.2.0", "2.x"},
+		{"beta-7", "beta"},
+		{"1.5.2", "1.4+"},
+		{"1.2.0", "1.x"},
+		{"0.9.0", ""},
+		{"8", "1.x"},
+		{"nightly", ""},
+	}
+	for _, tc := range tests {
+		routed = ""
+		c := newChannel(tc.version, SessionId{}, make(chan SessionId, 1), "", channelSettings{})
+		r.ServeChannel(c)
+		if routed != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.version, tc.expected, routed)
+		}
+		if len(tc.expected) > 0 {
+			c.terminate(CloseClientTerminated)
+			continue
+		}
+
+		reason := c.CloseReason()
+		if reason == nil || *reason != (CloseReason{CloseUnsupportedVersion, DefaultUnsupportedVersionMessage}) {
+			t.Errorf("%s: expected the channel to be rejected, got %v", tc.version, reason)
+		}
+		c.terminate(CloseClientTerminated)
+	}
+
+	// The unsupported versions go to the fallback handler when there is one.
+	r.HandleFallback(handler("fallback"))
+	c := newChannel("0.9.0", SessionId{}, make(chan SessionId, 1), "", channelSettings{})
+	defer c.terminate(CloseClientTerminated)
+	r.ServeChannel(c)
+	if routed != "fallback" || c.CloseReason() != nil {
+		t.Errorf("expected the fallback handler, got %q and %v", routed, c.CloseReason())
+	}
+}
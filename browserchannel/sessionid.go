@@ -4,18 +4,43 @@
 package browserchannel
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"io"
+	"strings"
+	"sync"
+	"time"
 )
 
-const bytesPerSessionId = 16
+const (
+	bytesPerSessionId = 16
+	// Size of the truncated HMAC of signed session ids.
+	bytesPerSessionIdMac = 16
+	// Size of the issue time of signed session ids.
+	bytesPerIssueTime = 4
+	maxNodeIdLength   = 32
+	// Separates the node id from the payload of signed session ids.
+	nodeIdSeparator = "."
+)
+
+// The maximum age of the signed session ids used by default, see
+// SessionIdSigner.SetMaxAge.
+const DefaultSessionIdMaxAge = 24 * time.Hour
 
 type SessionId [bytesPerSessionId]byte
 
 var (
-	nullSessionId       = SessionId{}
-	errInvalidSessionId = errors.New("invalid session id string")
+	nullSessionId        = SessionId{}
+	errInvalidSessionId  = errors.New("invalid session id string")
+	errUnsignedSessionId = errors.New("session id isn't signed")
+	errForgedSessionId   = errors.New("session id signature mismatch")
+	errExpiredSessionId  = errors.New("session id expired")
+	errForeignSessionId  = errors.New("session id issued by another node")
+	errInvalidNodeId     = errors.New("invalid node id")
+	errNoSigningKey      = errors.New("no signing key")
 )
 
 // Generates a SessionId using the given reader as byte source.
@@ -51,3 +76,215 @@ func parseSessionId(repr string) (sid SessionId, err error) {
 func (s SessionId) String() string {
 	return hex.EncodeToString(s[:])
 }
+
+// Encodes the SessionId using its hexadecimal representation.
+func (s SessionId) MarshalText() ([]byte, error) {
+	if s == nullSessionId {
+		return []byte{}, nil
+	}
+	return []byte(s.String()), nil
+}
+
+// Decodes the hexadecimal representation of a SessionId.
+func (s *SessionId) UnmarshalText(text []byte) (err error) {
+	*s, err = parseSessionId(string(text))
+	return
+}
+
+// Signs the session ids issued by a handler and verifies the session ids sent
+// by the clients, so forged session ids are rejected without a session lookup.
+//
+// A signed session id has the form node.payload where node is the id of the
+// node that issued it and payload is the hexadecimal encoding of the issue
+// time, the random session id and a HMAC-SHA256 of the three, truncated to 16
+// bytes. Load balancers can route the requests of a session to the node owning
+// it by matching the node id prefix of the SID parameter, see SessionIdNode.
+type SessionIdSigner struct {
+	nodeId string
+	lock   sync.RWMutex
+	// The first key signs the session ids, all of them verify the signatures.
+	keys   [][]byte
+	maxAge time.Duration
+}
+
+// Creates a signer for the given node. The first key signs the session ids
+// while the others are only used to verify them. Node ids are limited to 32
+// ASCII letters, digits, dashes and underscores.
+func NewSessionIdSigner(nodeId string, keys ...[]byte) (s *SessionIdSigner, err error) {
+	if !isValidNodeId(nodeId) {
+		return nil, errInvalidNodeId
+	}
+	s = &SessionIdSigner{nodeId: nodeId, maxAge: DefaultSessionIdMaxAge}
+	if err = s.SetKeys(keys...); err != nil {
+		s = nil
+	}
+	return
+}
+
+func isValidNodeId(nodeId string) bool {
+	if len(nodeId) == 0 || len(nodeId) > maxNodeIdLength {
+		return false
+	}
+	for _, c := range nodeId {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the id of the node issuing the session ids.
+func (s *SessionIdSigner) NodeId() string {
+	return s.nodeId
+}
+
+// Replaces the keys of the signer. The first key signs the session ids while
+// the others are only used to verify them.
+func (s *SessionIdSigner) SetKeys(keys ...[]byte) error {
+	if len(keys) == 0 || len(keys[0]) == 0 {
+		return errNoSigningKey
+	}
+
+	copied := make([][]byte, len(keys))
+	for i, key := range keys {
+		copied[i] = append([]byte(nil), key...)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys = copied
+	return nil
+}
+
+// Makes the given key the signing key. The session ids signed with the
+// previous signing key are still accepted while those signed with older keys
+// are rejected.
+func (s *SessionIdSigner) RotateKey(key []byte) error {
+	if len(key) == 0 {
+		return errNoSigningKey
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys = [][]byte{append([]byte(nil), key...), s.keys[0]}
+	return nil
+}
+
+// Sets the maximum age of the session ids, past which they are rejected as
+// unknown and the clients have to create a new session. The age isn't
+// limited when zero.
+func (s *SessionIdSigner) SetMaxAge(maxAge time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.maxAge = maxAge
+}
+
+func computeSessionIdMac(key []byte, nodeId string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, nodeId)
+	mac.Write(payload)
+	return mac.Sum(nil)[:bytesPerSessionIdMac]
+}
+
+// Returns the signed representation of the session id. A nil signer returns
+// the hexadecimal representation of the session id.
+func (s *SessionIdSigner) sign(sid SessionId, issued time.Time) string {
+	if s == nil {
+		return sid.String()
+	}
+
+	s.lock.RLock()
+	key := s.keys[0]
+	s.lock.RUnlock()
+
+	payload := make([]byte, bytesPerIssueTime, bytesPerIssueTime+bytesPerSessionId+bytesPerSessionIdMac)
+	binary.BigEndian.PutUint32(payload, uint32(issued.Unix()))
+	payload = append(payload, sid[:]...)
+	payload = append(payload, computeSessionIdMac(key, s.nodeId, payload)...)
+
+	return s.nodeId + nodeIdSeparator + hex.EncodeToString(payload)
+}
+
+// Parses and verifies a signed session id. A nil signer parses the
+// hexadecimal representation of the session id. As with parseSessionId, an
+// empty string yields nullSessionId.
+//
+// Malformed session ids, including the unsigned ones issued before the signer
+// was set, are rejected with errUnsignedSessionId, those whose signature
+// doesn't match with errForgedSessionId, those older than the maximum age with
+// errExpiredSessionId and those issued by another node with
+// errForeignSessionId, along with the issuing node id. A signature that
+// doesn't match may also be the one of a retired key, see isUnknownSessionId.
+func (s *SessionIdSigner) parse(repr string) (sid SessionId, node string, issued time.Time, err error) {
+	if s == nil || len(repr) == 0 {
+		sid, err = parseSessionId(repr)
+		return
+	}
+
+	sid = nullSessionId
+
+	i := strings.Index(repr, nodeIdSeparator)
+	if i < 0 || !isValidNodeId(repr[:i]) {
+		err = errUnsignedSessionId
+		return
+	}
+
+	node = repr[:i]
+	payload, derr := hex.DecodeString(repr[i+1:])
+	if derr != nil || len(payload) != bytesPerIssueTime+bytesPerSessionId+bytesPerSessionIdMac {
+		err = errUnsignedSessionId
+		return
+	}
+
+	signed, mac := payload[:len(payload)-bytesPerSessionIdMac], payload[len(payload)-bytesPerSessionIdMac:]
+
+	s.lock.RLock()
+	keys := s.keys
+	maxAge := s.maxAge
+	s.lock.RUnlock()
+
+	valid := false
+	for _, key := range keys {
+		if hmac.Equal(mac, computeSessionIdMac(key, node, signed)) {
+			valid = true
+			break
+		}
+	}
+
+	if !valid {
+		err = errForgedSessionId
+		return
+	}
+
+	issued = time.Unix(int64(binary.BigEndian.Uint32(signed)), 0)
+	copy(sid[:], signed[bytesPerIssueTime:])
+
+	// Expired session ids are rejected by every node so they aren't
+	// forwarded to their owner.
+	if maxAge > 0 && time.Since(issued) > maxAge {
+		sid = nullSessionId
+		err = errExpiredSessionId
+	} else if node != s.nodeId {
+		err = errForeignSessionId
+	}
+	return
+}
+
+// Returns whether a session id was rejected because it can't be verified,
+// i.e. it isn't signed, e.g. it was issued before the signer was set, it
+// expired or it was signed with a retired key, which can't be told apart from
+// a forged one. Such session ids are answered as unknown session ids so the
+// clients create a new session.
+func isUnknownSessionId(err error) bool {
+	return err == errUnsignedSessionId || err == errForgedSessionId || err == errExpiredSessionId
+}
+
+// Returns the id of the node that issued the given signed session id, or an
+// empty string if the session id isn't signed. The signature isn't verified.
+func SessionIdNode(repr string) string {
+	if i := strings.Index(repr, nodeIdSeparator); i > 0 && isValidNodeId(repr[:i]) {
+		return repr[:i]
+	}
+	return ""
+}
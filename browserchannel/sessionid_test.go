@@ -5,7 +5,12 @@ package browserchannel
 
 import (
 	"bytes"
+	"crypto/rand"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestParseSessionId(t *testing.T) {
@@ -45,3 +50,180 @@ func TestParseSessionId(t *testing.T) {
 		}
 	}
 }
+
+func TestSignedSessionId(t *testing.T) {
+	signer, err := NewSessionIdSigner("node-1", []byte("key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sid, _ := generateSesionId(rand.Reader)
+	issued := time.Now().Add(-time.Hour).Truncate(time.Second)
+	repr := signer.sign(sid, issued)
+
+	if !strings.HasPrefix(repr, "node-1.") {
+		t.Errorf("expected node prefix, got %s", repr)
+	}
+	if node := SessionIdNode(repr); node != "node-1" {
+		t.Errorf("expected node-1, got %s", node)
+	}
+
+	parsed, node, parsedIssued, err := signer.parse(repr)
+	if err != nil || parsed != sid || node != "node-1" || !parsedIssued.Equal(issued) {
+		t.Errorf("expected %s issued at %s, got %s issued at %s by %s (%v)",
+			sid, issued, parsed, parsedIssued, node, err)
+	}
+
+	// Flip the last hexadecimal digit of the signature.
+	last := repr[len(repr)-1]
+	tampered := repr[:len(repr)-1] + map[bool]string{true: "1", false: "0"}[last == '0']
+
+	cases := []struct {
+		repr string
+		err  error
+	}{
+		{"", nil},
+		{sid.String(), errUnsignedSessionId},
+		{tampered, errForgedSessionId},
+		{"node-2" + repr[len("node-1"):], errForgedSessionId},
+		{"node-1.zz", errUnsignedSessionId},
+		{"no.de." + repr, errUnsignedSessionId},
+	}
+
+	for _, c := range cases {
+		if _, _, _, err := signer.parse(c.repr); err != c.err {
+			t.Errorf("expected %v, got %v for %s", c.err, err, c.repr)
+		}
+	}
+}
+
+func TestSessionIdKeyRotation(t *testing.T) {
+	signer, _ := NewSessionIdSigner("a", []byte("key1"))
+	other, _ := NewSessionIdSigner("b", []byte("key1"))
+
+	sid, _ := generateSesionId(rand.Reader)
+	old := signer.sign(sid, time.Now())
+
+	// Session ids of other nodes are verified with the shared keys.
+	if _, node, _, err := other.parse(old); err != errForeignSessionId || node != "a" {
+		t.Errorf("expected foreign session id of node a, got %v from %s", err, node)
+	}
+
+	signer.RotateKey([]byte("key2"))
+	current := signer.sign(sid, time.Now())
+	if _, _, _, err := signer.parse(old); err != nil {
+		t.Errorf("expected previous key to be accepted, got %v", err)
+	}
+
+	signer.RotateKey([]byte("key3"))
+	if _, _, _, err := signer.parse(old); err != errForgedSessionId {
+		t.Errorf("expected retired key to be rejected, got %v", err)
+	}
+	if _, _, _, err := signer.parse(current); err != nil {
+		t.Errorf("expected previous key to be accepted, got %v", err)
+	}
+}
+
+func TestSessionIdConcurrentKeyRotations(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		signer, _ := NewSessionIdSigner("a", []byte("key1"))
+
+		var wg sync.WaitGroup
+		for _, key := range []string{"key2", "key3"} {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				signer.RotateKey([]byte(key))
+			}(key)
+		}
+		wg.Wait()
+
+		// Each rotation has to keep the key set by the other one.
+		keys := map[string]bool{}
+		for _, key := range signer.keys {
+			keys[string(key)] = true
+		}
+		if len(keys) != 2 || !keys["key2"] || !keys["key3"] {
+			t.Fatalf("expected key2 and key3, got %q", signer.keys)
+		}
+	}
+}
+
+func TestSessionIdMaxAge(t *testing.T) {
+	signer, _ := NewSessionIdSigner("a", []byte("key"))
+	other, _ := NewSessionIdSigner("b", []byte("key"))
+	sid, _ := generateSesionId(rand.Reader)
+
+	recent := signer.sign(sid, time.Now().Add(-DefaultSessionIdMaxAge+time.Minute))
+	if _, _, _, err := signer.parse(recent); err != nil {
+		t.Errorf("expected recent session id to be accepted, got %v", err)
+	}
+
+	// Expired session ids aren't forwarded to the node that issued them.
+	old := signer.sign(sid, time.Now().Add(-DefaultSessionIdMaxAge-time.Minute))
+	for _, s := range []*SessionIdSigner{signer, other} {
+		if _, _, _, err := s.parse(old); err != errExpiredSessionId {
+			t.Errorf("expected %v, got %v", errExpiredSessionId, err)
+		}
+	}
+
+	signer.SetMaxAge(0)
+	if _, _, _, err := signer.parse(old); err != nil {
+		t.Errorf("expected unlimited age, got %v", err)
+	}
+}
+
+func TestHandlerUnverifiableSessionId(t *testing.T) {
+	signer, _ := NewSessionIdSigner("a", []byte("key1"))
+	h := NewHandler(func(c *Channel) {})
+	h.SetSessionIdSigner(signer)
+
+	sid, _ := generateSesionId(rand.Reader)
+	retired := signer.sign(sid, time.Now())
+	signer.RotateKey([]byte("key2"))
+	signer.RotateKey([]byte("key3"))
+	expired := signer.sign(sid, time.Now().Add(-2*DefaultSessionIdMaxAge))
+
+	cases := []struct {
+		sid      string
+		expected string
+	}{
+		{retired, "Unknown SID"},
+		{expired, "Unknown SID"},
+		{"a.zz", "Unknown SID"},
+		// Session ids issued before the signer was set.
+		{sid.String(), "Unknown SID"},
+	}
+
+	for _, c := range cases {
+		for _, path := range []string{"/channel/bind", "/channel/ws"} {
+			req := httptest.NewRequest("GET", path+"?VER=8&RID=rpc&SID="+c.sid, nil)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != 400 || rec.Body.String() != c.expected {
+				t.Errorf("%s %s: expected 400 %q, got %d %q", path, c.sid, c.expected, rec.Code, rec.Body)
+			}
+		}
+	}
+}
+
+func TestNewSessionIdSigner(t *testing.T) {
+	cases := []struct {
+		nodeId string
+		keys   [][]byte
+		err    error
+	}{
+		{"node", [][]byte{[]byte("key")}, nil},
+		{"", [][]byte{[]byte("key")}, errInvalidNodeId},
+		{"no.de", [][]byte{[]byte("key")}, errInvalidNodeId},
+		{strings.Repeat("n", 33), [][]byte{[]byte("key")}, errInvalidNodeId},
+		{"node", nil, errNoSigningKey},
+		{"node", [][]byte{{}}, errNoSigningKey},
+	}
+
+	for _, c := range cases {
+		if _, err := NewSessionIdSigner(c.nodeId, c.keys...); err != c.err {
+			t.Errorf("expected %v, got %v for %q", c.err, err, c.nodeId)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// An array persisted in an OutgoingStore.
+type StoredArray struct {
+	Id   int             `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+// A session persisted in an OutgoingStore along with its unacknowledged
+// arrays, in order.
+type StoredSession struct {
+	Sid       SessionId `json:"sid"`
+	SidString string    `json:"sidString"`
+	Version   string    `json:"version"`
+	// The key identifying the client, see ClientKeyFunc.
+	ClientKey string `json:"clientKey,omitempty"`
+	// The id of the last array sent on the channel, persisted or not.
+	LastArrayId int            `json:"lastArrayId,omitempty"`
+	Arrays      []*StoredArray `json:"arrays,omitempty"`
+}
+
+// Persists the arrays queued on the channels until the clients acknowledge
+// them, so they can be delivered once the sessions are restored after a
+// restart. See Handler.SetOutgoingStore and Handler.RestoreSessions.
+type OutgoingStore interface {
+	// Registers a new session. Its arrays field is ignored.
+	Open(s *StoredSession) error
+	// Appends an array to the queue of a session.
+	Append(sid SessionId, a *StoredArray) error
+	// Records the id of an array that isn't persisted, e.g. a heartbeat, so
+	// the restored session doesn't reuse it.
+	Advance(sid SessionId, id int) error
+	// Removes an array that was dropped or replaced before being
+	// acknowledged.
+	Delete(sid SessionId, id int) error
+	// Removes the arrays whose id is lower or equal to aid.
+	Acknowledge(sid SessionId, aid int) error
+	// Removes a closed session and its arrays.
+	Remove(sid SessionId) error
+	// Returns the sessions that weren't removed.
+	Load() ([]*StoredSession, error)
+}
+
+// A record of the FileStore log.
+type storeRecord struct {
+	Op      string          `json:"op"`
+	Sid     SessionId       `json:"sid"`
+	Session *StoredSession  `json:"session,omitempty"`
+	Id      int             `json:"id,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+const (
+	storeOpen        = "open"
+	storeAppend      = "append"
+	storeAdvance     = "advance"
+	storeDelete      = "delete"
+	storeAcknowledge = "ack"
+	storeRemove      = "remove"
+)
+
+// An OutgoingStore appending its operations to a log file, one JSON record per
+// line. The sessions are also kept in memory. The log is compacted when the
+// store is opened and whenever it holds more than twice as many records as
+// needed to describe the live sessions.
+type FileStore struct {
+	lock     sync.Mutex
+	path     string
+	file     *os.File
+	w        *bufio.Writer
+	sync     bool
+	sessions map[SessionId]*StoredSession
+	records  int
+	live     int
+}
+
+// Opens the store persisted in the file at the given path, creating it if
+// needed. When sync is true, the file is synced after each operation, which
+// guarantees that the acknowledged operations survive a system crash and not
+// only a process restart.
+func NewFileStore(path string, sync bool) (s *FileStore, err error) {
+	s = &FileStore{path: path, sync: sync, sessions: make(map[SessionId]*StoredSession)}
+
+	if err = s.replay(); err != nil {
+		return nil, err
+	}
+	if err = s.compact(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Rebuilds the sessions from the log file. A truncated last record, e.g. after
+// a crash during a write, is ignored.
+func (s *FileStore) replay() (err error) {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var r storeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			log.Printf("store: ignoring bad record: %s\n", err)
+			continue
+		}
+		s.apply(&r)
+	}
+	return scanner.Err()
+}
+
+// Applies the record to the in-memory sessions.
+func (s *FileStore) apply(r *storeRecord) {
+	session := s.sessions[r.Sid]
+
+	switch r.Op {
+	case storeOpen:
+		if r.Session != nil {
+			s.sessions[r.Sid] = &StoredSession{Sid: r.Sid, SidString: r.Session.SidString,
+				Version: r.Session.Version, ClientKey: r.Session.ClientKey,
+				LastArrayId: r.Session.LastArrayId}
+			s.live++
+		}
+	case storeAppend:
+		if session != nil {
+			session.Arrays = append(session.Arrays, &StoredArray{r.Id, r.Data})
+			if r.Id > session.LastArrayId {
+				session.LastArrayId = r.Id
+			}
+			s.live++
+		}
+	case storeAdvance:
+		if session != nil {
+			session.LastArrayId = r.Id
+		}
+	case storeDelete:
+		if session != nil {
+			for i, a := range session.Arrays {
+				if a.Id == r.Id {
+					session.Arrays = append(session.Arrays[:i], session.Arrays[i+1:]...)
+					s.live--
+					break
+				}
+			}
+		}
+	case storeAcknowledge:
+		if session != nil {
+			i := 0
+			for i < len(session.Arrays) && session.Arrays[i].Id <= r.Id {
+				i++
+			}
+			session.Arrays = append([]*StoredArray(nil), session.Arrays[i:]...)
+			s.live -= i
+		}
+	case storeRemove:
+		if session != nil {
+			delete(s.sessions, r.Sid)
+			s.live -= 1 + len(session.Arrays)
+		}
+	}
+}
+
+// Rewrites the log file with the records describing the live sessions.
+func (s *FileStore) compact() (err error) {
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+
+	w := bufio.NewWriter(file)
+	records := 0
+	for _, session := range s.sessions {
+		// The arrays are written as append records.
+		open := *session
+		open.Arrays = nil
+		if err = writeStoreRecord(w, &storeRecord{Op: storeOpen, Sid: session.Sid, Session: &open}); err != nil {
+			break
+		}
+		records++
+		for _, a := range session.Arrays {
+			if err = writeStoreRecord(w, &storeRecord{Op: storeAppend, Sid: session.Sid, Id: a.Id, Data: a.Data}); err != nil {
+				break
+			}
+			records++
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	if s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return
+	}
+	s.w = bufio.NewWriter(s.file)
+	s.records = records
+	s.live = records
+	return
+}
+
+func writeStoreRecord(w *bufio.Writer, r *storeRecord) (err error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	if _, err = w.Write(data); err == nil {
+		err = w.WriteByte('\n')
+	}
+	return
+}
+
+// Appends the record to the log and applies it.
+func (s *FileStore) append(r *storeRecord) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err = writeStoreRecord(s.w, r); err != nil {
+		return
+	}
+	if err = s.w.Flush(); err != nil {
+		return
+	}
+	if s.sync {
+		if err = s.file.Sync(); err != nil {
+			return
+		}
+	}
+
+	s.apply(r)
+	s.records++
+
+	if s.records > 1024 && s.records > 2*s.live {
+		err = s.compact()
+	}
+	return
+}
+
+func (s *FileStore) Open(session *StoredSession) error {
+	return s.append(&storeRecord{Op: storeOpen, Sid: session.Sid, Session: session})
+}
+
+func (s *FileStore) Append(sid SessionId, a *StoredArray) error {
+	return s.append(&storeRecord{Op: storeAppend, Sid: sid, Id: a.Id, Data: a.Data})
+}
+
+func (s *FileStore) Advance(sid SessionId, id int) error {
+	return s.append(&storeRecord{Op: storeAdvance, Sid: sid, Id: id})
+}
+
+func (s *FileStore) Delete(sid SessionId, id int) error {
+	return s.append(&storeRecord{Op: storeDelete, Sid: sid, Id: id})
+}
+
+func (s *FileStore) Acknowledge(sid SessionId, aid int) error {
+	return s.append(&storeRecord{Op: storeAcknowledge, Sid: sid, Id: aid})
+}
+
+func (s *FileStore) Remove(sid SessionId) error {
+	return s.append(&storeRecord{Op: storeRemove, Sid: sid})
+}
+
+func (s *FileStore) Load() (sessions []*StoredSession, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, session := range s.sessions {
+		copied := *session
+		copied.Arrays = append([]*StoredArray(nil), session.Arrays...)
+		sessions = append(sessions, &copied)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].SidString < sessions[j].SidString
+	})
+	return
+}
+
+// Closes the log file.
+func (s *FileStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.file.Close()
+}
+
+// Sets the store persisting the arrays sent on the channels until they are
+// acknowledged. The heartbeats and the arrays sent by the server to open or
+// close a channel aren't persisted. Closed sessions are removed from the
+// store, including the sessions closed by Shutdown, so a server that needs to
+// restore its sessions after a restart should exit without calling Shutdown.
+func (h *Handler) SetOutgoingStore(store OutgoingStore) {
+	h.settings.store = store
+}
+
+// Restores the sessions of the outgoing store, typically when the server
+// starts. The restored channels are handed to the channel handler and their
+// unacknowledged arrays are sent again once the clients reconnect. Sessions
+// whose client doesn't reconnect time out as usual. The restored sessions
+// count against the session limits but aren't refused by them.
+func (h *Handler) RestoreSessions() (err error) {
+	store := h.settings.store
+	if store == nil {
+		return
+	}
+
+	sessions, err := store.Load()
+	if err != nil {
+		return
+	}
+
+	for _, s := range sessions {
+		log.Printf("restoring session %s with %d arrays\n", s.Sid, len(s.Arrays))
+		h.limiter.add(s.ClientKey, time.Now())
+		channel := newChannel(s.Version, s.Sid, h.gcChan, "", h.settings)
+		channel.restore(s)
+		if !h.channels.set(s.Sid, channel) {
+			channel.terminate(CloseHandlerShutdown)
+			h.limiter.release(s.ClientKey, time.Now())
+			return errShutdown
+		}
+		channel.armChannelTimeout()
+		go h.chanHandler(channel)
+	}
+	return
+}
+
+// Restores the state of a channel whose 'c' array was already sent.
+func (c *Channel) restore(s *StoredSession) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.sidString = s.SidString
+	c.clientKey = s.ClientKey
+	c.state = channelReady
+	// The id of the next map is learned from the first forward channel
+	// request.
+	c.maps.next = -1
+
+	for _, a := range s.Arrays {
+		c.outgoingArrays = append(c.outgoingArrays,
+			&outgoingArray{a.Id, nil, a.Data, false, ""})
+		c.outgoingBytes += len(a.Data)
+		c.lastArrayId = a.Id
+	}
+	// The arrays that weren't persisted, e.g. the heartbeats, may have been
+	// sent after the last persisted array.
+	if s.LastArrayId > c.lastArrayId {
+		c.lastArrayId = s.LastArrayId
+	}
+	c.lastSentArrayId = c.lastArrayId
+
+	go heartbeat(c, c.backChannelHeartbeat.C, c.ctx.Done())
+}
+
+// Persists a new session in the outgoing store.
+func (c *Channel) storeSession() {
+	if store := c.settings.store; store != nil {
+		err := store.Open(&StoredSession{Sid: c.Sid, SidString: c.sidString,
+			Version: c.Version, ClientKey: c.clientKey})
+		if err != nil {
+			c.log("store session: %s", err)
+		}
+	}
+}
+
+// Queues an operation of the outgoing store while holding the channel lock.
+// The operations are performed by performStoreOps.
+func (c *Channel) queueStoreOp(op func(OutgoingStore)) {
+	if c.settings.store != nil {
+		c.storeOps = append(c.storeOps, op)
+	}
+}
+
+// Performs the queued operations of the outgoing store, in order, so the
+// store I/O doesn't block the channel. The operations queued while another
+// goroutine performs them are left to it. Must be called without holding the
+// channel lock.
+func (c *Channel) performStoreOps() {
+	store := c.settings.store
+	if store == nil {
+		return
+	}
+
+	c.lock.Lock()
+	if c.storeOpsRunning {
+		c.lock.Unlock()
+		return
+	}
+	c.storeOpsRunning = true
+
+	for len(c.storeOps) > 0 {
+		ops := c.storeOps
+		c.storeOps = nil
+		c.lock.Unlock()
+
+		for _, op := range ops {
+			op(store)
+		}
+		c.lock.Lock()
+	}
+
+	c.storeOpsRunning = false
+	c.lock.Unlock()
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func storedIds(s *StoredSession) (ids []int) {
+	for _, a := range s.Arrays {
+		ids = append(ids, a.Id)
+	}
+	return
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+
+	store, err := NewFileStore(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := SessionId{1}, SessionId{2}
+	store.Open(&StoredSession{Sid: a, SidString: "a", Version: "8", ClientKey: "client"})
+	store.Open(&StoredSession{Sid: b, SidString: "b", Version: "8"})
+	for id := 2; id <= 5; id++ {
+		store.Append(a, &StoredArray{id, []byte(`["x"]`)})
+	}
+	store.Append(b, &StoredArray{2, []byte(`["y"]`)})
+	store.Advance(a, 6)
+	store.Acknowledge(a, 2)
+	store.Delete(a, 4)
+	store.Remove(b)
+	store.Close()
+
+	// Simulate a crash in the middle of a write.
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"op":"append","sid":"01`)
+	f.Close()
+
+	store, err = NewFileStore(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	sessions, _ := store.Load()
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(sessions))
+	}
+
+	s := sessions[0]
+	if s.Sid != a || s.SidString != "a" || s.Version != "8" || s.ClientKey != "client" || s.LastArrayId != 6 {
+		t.Errorf("unexpected session %#v", s)
+	}
+	if ids := storedIds(s); !reflect.DeepEqual(ids, []int{3, 5}) {
+		t.Errorf("expected arrays [3 5], got %v", ids)
+	}
+	if string(s.Arrays[0].Data) != `["x"]` {
+		t.Errorf("expected [\"x\"], got %s", s.Arrays[0].Data)
+	}
+
+	// The compacted file holds each array once and preserves the session.
+	data, _ := os.ReadFile(path)
+	if n := strings.Count(string(data), `"append"`); n != 2 || strings.Contains(string(data), `"arrays"`) {
+		t.Errorf("expected 2 append records and no embedded arrays, got %s", data)
+	}
+	reopened, err := NewFileStore(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	sessions, _ = reopened.Load()
+	if len(sessions) != 1 || sessions[0].LastArrayId != 6 || !reflect.DeepEqual(storedIds(sessions[0]), []int{3, 5}) {
+		t.Errorf("unexpected sessions after compaction %#v", sessions)
+	}
+}
+
+func TestRestoreSessions(t *testing.T) {
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "store"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	h := NewHandler(func(*Channel) {})
+	h.SetOutgoingStore(store)
+	c, err := h.createChannel("8", &RequestInfo{ClientKey: "client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc := &fakeBackChannel{}
+	c.setBackChannel(bc)
+	c.SendArray(Array{"a"})
+	c.SendArray(Array{"b"})
+	c.SendArray(Array{"c"})
+	c.sendArray(noopArray, SendOptions{}, false /* durable */)
+	c.acknowledgeArrays(2)
+
+	// The handler of the restarted server.
+	restored := make(chan *Channel, 1)
+	h = NewHandler(func(c *Channel) { restored <- c })
+	h.SetOutgoingStore(store)
+	if err := h.RestoreSessions(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-restored
+	if r.Sid != c.Sid {
+		t.Errorf("expected session %s, got %s", c.Sid, r.Sid)
+	}
+	if sessions := h.limiter.sessions; sessions != 1 || r.clientKey != "client" {
+		t.Errorf("expected a session of client, got %d of %q", sessions, r.clientKey)
+	}
+
+	// The unacknowledged arrays are sent without the 'c' array, and the
+	// new arrays follow the heartbeat.
+	bc = &fakeBackChannel{}
+	r.setBackChannel(bc)
+	r.SendArray(Array{"d"})
+
+	expected := []string{`[[3,["b"]],[4,["c"]]]`, `[[6,["d"]]]`}
+	if chunks := bc.getChunks(); !equalStrings(chunks, expected) {
+		t.Errorf("expected %v, got %v", expected, chunks)
+	}
+
+	// The maps are delivered from the first id sent by the client.
+	r.receiveMaps(nil, 7, []Map{{"k": "v"}}, nil)
+	if m := <-r.Maps(); m["k"] != "v" {
+		t.Errorf("expected map, got %v", m)
+	}
+
+	// The session is released once closed.
+	r.terminate(CloseClientTerminated)
+	for i := 0; i < 100 && h.channels.get(r.Sid) != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	h.limiter.Lock()
+	defer h.limiter.Unlock()
+	if h.limiter.sessions != 0 {
+		t.Errorf("expected the session to be released, got %d sessions", h.limiter.sessions)
+	}
+}
+
+// A store whose appends block until released.
+type blockingStore struct {
+	OutgoingStore
+	appending chan bool
+	release   chan bool
+}
+
+func (s *blockingStore) Append(sid SessionId, a *StoredArray) error {
+	s.appending <- true
+	<-s.release
+	return s.OutgoingStore.Append(sid, a)
+}
+
+func TestStoreDoesntBlockChannel(t *testing.T) {
+	file, err := NewFileStore(filepath.Join(t.TempDir(), "store"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	store := &blockingStore{file, make(chan bool), make(chan bool)}
+
+	h := NewHandler(func(*Channel) {})
+	h.SetOutgoingStore(store)
+	c, err := h.createChannel("8", &RequestInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.terminate(CloseClientTerminated)
+	c.setBackChannel(&fakeBackChannel{})
+
+	go c.SendArray(Array{"a"})
+	<-store.appending
+
+	done := make(chan bool)
+	go func() {
+		c.getState()
+		c.acknowledgeArrays(2)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the channel is blocked by the store")
+	}
+
+	// The operations queued meanwhile are performed in order.
+	c.SendArray(Array{"b"})
+	close(store.release)
+	<-store.appending
+
+	for i := 0; i < 100; i++ {
+		sessions, _ := file.Load()
+		if len(sessions) == 1 && sessions[0].LastArrayId == 3 {
+			if ids := storedIds(sessions[0]); !reflect.DeepEqual(ids, []int{3}) {
+				t.Errorf("expected arrays [3], got %v", ids)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expected the arrays to be stored")
+}
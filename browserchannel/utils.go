@@ -4,19 +4,22 @@
 package browserchannel
 
 import (
+	"bufio"
 	"errors"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 var (
 	errBadMap       = errors.New("bad map")
+	errBadMapType   = errors.New("map flagged as bad by the client")
 	errBodyTooLarge = errors.New("body too large")
+	errMapTooLarge  = errors.New("map limits exceeded")
 )
 
 // Creates a regexp that matches an origin and all its subdomains. Both http
@@ -32,27 +35,193 @@ func setHeaders(rw http.ResponseWriter, headers *map[string]string) {
 	}
 }
 
-// Parses the body of a POST request.
-func parseBody(r io.ReadCloser) (values url.Values, err error) {
-	maxFormSize := int64(10 << 20)
+// Flushes the response, including through the response writers wrapping it
+// that implement an Unwrap method. Returns http.ErrNotSupported if the
+// response can't be flushed.
+func flush(rw http.ResponseWriter) error {
+	return http.NewResponseController(rw).Flush()
+}
 
-	// Let the reader read 1 more byte and blow up if he does.
-	reader := io.LimitReader(r, maxFormSize+1)
+// Checks whether the response can be flushed by flush, i.e. whether the
+// response writer or one of the response writers it wraps implements one of
+// the flush methods looked up by http.ResponseController, without flushing
+// the response. Responses that can't be flushed are only received by the
+// client once complete.
+func canFlush(rw http.ResponseWriter) bool {
+	for {
+		switch rw.(type) {
+		case interface{ FlushError() error }, http.Flusher:
+			return true
+		}
+		u, ok := rw.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false
+		}
+		rw = u.Unwrap()
+	}
+}
 
-	body, err := ioutil.ReadAll(reader)
-	if err != nil {
-		return
+// Returns the length of the UTF-8 encoded data in UTF-16 code units, which is
+// how the client measures the length of the response text. Characters outside
+// the Basic Multilingual Plane count as two units, i.e. a surrogate pair.
+func utf16Length(data []byte) (n int) {
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+		data = data[size:]
 	}
+	return
+}
 
-	if int64(len(body)) > maxFormSize {
-		err = errBodyTooLarge
-		return
+// Prefixes the data with its length in UTF-16 code units followed by a new
+// line, as expected by the XHR client.
+func lengthPrefixed(data []byte) []byte {
+	prefix := strconv.Itoa(utf16Length(data)) + "\n"
+	return append([]byte(prefix), data...)
+}
+
+// Escapes the non-ASCII characters of the JSON encoded data as \uXXXX
+// sequences, using surrogate pairs for the characters outside the Basic
+// Multilingual Plane. Non-ASCII characters only appear in JSON strings, where
+// such escapes are valid.
+func escapeNonAscii(data []byte) []byte {
+	var escaped []byte
+	for i := 0; i < len(data); {
+		if data[i] < utf8.RuneSelf {
+			if escaped != nil {
+				escaped = append(escaped, data[i])
+			}
+			i++
+			continue
+		}
+
+		if escaped == nil {
+			escaped = append(make([]byte, 0, len(data)+16), data[:i]...)
+		}
+
+		r, size := utf8.DecodeRune(data[i:])
+		if r >= 0x10000 {
+			r -= 0x10000
+			escaped = appendUnicodeEscape(escaped, 0xd800+(r>>10))
+			escaped = appendUnicodeEscape(escaped, 0xdc00+(r&0x3ff))
+		} else {
+			escaped = appendUnicodeEscape(escaped, r)
+		}
+		i += size
+	}
+
+	if escaped == nil {
+		return data
+	}
+	return escaped
+}
+
+func appendUnicodeEscape(b []byte, r rune) []byte {
+	const hex = "0123456789abcdef"
+	return append(b, '\\', 'u', hex[r>>12&0xf], hex[r>>8&0xf], hex[r>>4&0xf], hex[r&0xf])
+}
+
+// Parses the URL encoded body of a POST request. The body is parsed one key
+// value pair at a time so the limits are enforced without buffering the whole
+// body.
+func parseBody(r io.Reader, limits *MapLimits) (values url.Values, err error) {
+	values = make(url.Values)
+
+	if limits.MaxBodySize > 0 {
+		// Let the reader read 1 more byte and blow up if he does.
+		r = &limitedReader{io.LimitReader(r, limits.MaxBodySize+1), limits.MaxBodySize, 0}
 	}
 
-	values, err = url.ParseQuery(string(body))
+	reader := bufio.NewReader(r)
+	maxPairs := limits.maxPairs()
+
+	for pairs := 0; ; pairs++ {
+		pair, rerr := readPair(reader, limits.maxPairLength())
+		if rerr == io.EOF {
+			return
+		} else if rerr != nil {
+			return nil, rerr
+		}
+
+		if maxPairs > 0 && pairs >= maxPairs {
+			return nil, errMapTooLarge
+		}
+
+		if len(pair) == 0 {
+			continue
+		}
+
+		key, value := pair, ""
+		if i := strings.Index(pair, "="); i >= 0 {
+			key, value = pair[:i], pair[i+1:]
+		}
+
+		if key, err = url.QueryUnescape(key); err != nil {
+			return nil, err
+		}
+		if value, err = url.QueryUnescape(value); err != nil {
+			return nil, err
+		}
+
+		values.Add(key, value)
+	}
+}
+
+// Writes the response refusing a forward channel request whose body couldn't
+// be parsed.
+func writeBodyError(rw http.ResponseWriter, err error) {
+	switch err {
+	case errBodyTooLarge, errMapTooLarge:
+		rw.WriteHeader(413)
+	default:
+		rw.WriteHeader(400)
+	}
+}
+
+// A reader returning errBodyTooLarge once more than max bytes were read.
+type limitedReader struct {
+	r    io.Reader
+	max  int64
+	read int64
+}
+
+func (l *limitedReader) Read(p []byte) (n int, err error) {
+	n, err = l.r.Read(p)
+	if l.read += int64(n); l.read > l.max {
+		err = errBodyTooLarge
+	}
 	return
 }
 
+// Reads the next '&' terminated key value pair. Pairs longer than max bytes
+// are rejected unless max is zero.
+func readPair(r *bufio.Reader, max int) (pair string, err error) {
+	var buf []byte
+	for {
+		b, rerr := r.ReadByte()
+		if rerr == io.EOF && len(buf) > 0 {
+			break
+		} else if rerr != nil {
+			return "", rerr
+		}
+
+		if b == '&' {
+			break
+		}
+
+		if max > 0 && len(buf) >= max {
+			return "", errMapTooLarge
+		}
+
+		buf = append(buf, b)
+	}
+	return string(buf), nil
+}
+
 // Transforms the url values of the following format
 //
 // {
@@ -72,7 +241,11 @@ func parseBody(r io.ReadCloser) (values url.Values, err error) {
 //         {abc: 'def'}
 //     ]
 // }
-func parseIncomingMaps(values url.Values) (offset int, maps []Map, err error) {
+//
+// The maps that were flagged as bad by the client or that exceed the map
+// limits are returned separately and left nil in the maps slice so the ids of
+// the following maps are preserved.
+func parseIncomingMaps(values url.Values, limits *MapLimits) (offset int, maps []Map, bad []*BadMap, err error) {
 	count, _ := strconv.Atoi(values.Get("count"))
 
 	if count == 0 {
@@ -80,6 +253,16 @@ func parseIncomingMaps(values url.Values) (offset int, maps []Map, err error) {
 		return
 	}
 
+	if count < 0 {
+		err = errBadMap
+		return
+	}
+
+	if limits.MaxMapsPerRequest > 0 && count > limits.MaxMapsPerRequest {
+		err = errMapTooLarge
+		return
+	}
+
 	offset, err = strconv.Atoi(values.Get("ofs"))
 
 	if err != nil {
@@ -88,42 +271,109 @@ func parseIncomingMaps(values url.Values) (offset int, maps []Map, err error) {
 		return
 	}
 
-	// TODO: Limit number of maps to avoid DOS attack.
 	maps = make([]Map, count)
 	for i := range maps {
 		maps[i] = make(Map)
 	}
 
+	errs := make([]error, count)
+	raw := make([]url.Values, count)
+
 	for key, values := range values {
-		err = parseMapEntry(maps, count, key, values[0])
-		if err != nil {
+		id, mapKey, ok, perr := parseMapKey(key, count)
+		if perr != nil {
 			offset = 0
 			maps = nil
+			err = perr
 			return
+		} else if !ok {
+			continue
+		}
+
+		if raw[id] == nil {
+			raw[id] = make(url.Values)
+		}
+		raw[id][key] = values
+
+		if errs[id] == nil {
+			errs[id] = checkMapEntry(maps[id], limits, mapKey, values[0])
+			maps[id][mapKey] = values[0]
+		}
+	}
+
+	for id, m := range maps {
+		if errs[id] == nil && m["type"] == badMapType {
+			errs[id] = errBadMapType
+		}
+		if errs[id] != nil {
+			maps[id] = nil
+			bad = append(bad, &BadMap{offset + id, raw[id], errs[id]})
 		}
 	}
 
 	return
 }
 
-func parseMapEntry(maps []Map, count int, key string, value string) (err error) {
-	// TODO: Figure out the correct way to handle that case.
-	if value == "_badmap" {
+// Checks the maps of a WebSocket message against the map limits. The bad maps
+// are left nil in the maps slice, as done by parseIncomingMaps.
+func checkIncomingMaps(offset int, maps []Map, limits *MapLimits) (bad []*BadMap, err error) {
+	if limits.MaxMapsPerRequest > 0 && len(maps) > limits.MaxMapsPerRequest {
+		err = errMapTooLarge
 		return
 	}
 
-	// Split "req9_key" in two parts ["9", "key"].
-	keyParts := strings.Split(strings.TrimLeft(key, "req"), "_")
+	for id, m := range maps {
+		var merr error
+		if limits.MaxKeysPerMap > 0 && len(m) > limits.MaxKeysPerMap {
+			merr = errMapTooLarge
+		}
+		for key, value := range m {
+			if merr == nil {
+				merr = checkMapEntry(nil, limits, key, value)
+			}
+		}
+		if merr == nil && m["type"] == badMapType {
+			merr = errBadMapType
+		}
+		if merr != nil {
+			maps[id] = nil
+			bad = append(bad, &BadMap{offset + id, nil, merr})
+		}
+	}
+
+	return
+}
+
+// Splits a "req9_key" request key into the map id and the map key. The key may
+// itself contain underscores, e.g. "req0___data__". Keys that don't belong to
+// a map are ignored.
+func parseMapKey(key string, count int) (id int, mapKey string, ok bool, err error) {
+	if !strings.HasPrefix(key, "req") {
+		return
+	}
+
+	keyParts := strings.SplitN(strings.TrimPrefix(key, "req"), "_", 2)
 
 	if len(keyParts) == 2 {
-		id, cerr := strconv.Atoi(keyParts[0])
-		if cerr != nil || id > count {
+		var cerr error
+		id, cerr = strconv.Atoi(keyParts[0])
+		if cerr != nil || id < 0 || id >= count {
 			err = errBadMap
 			return
 		}
-		mapKey := keyParts[1]
-		maps[id][mapKey] = value
+		mapKey, ok = keyParts[1], true
 	}
 
 	return
 }
+
+// Checks whether a map entry can be added to the map without exceeding the
+// map limits.
+func checkMapEntry(m Map, limits *MapLimits, key string, value string) (err error) {
+	if (limits.MaxKeyLength > 0 && len(key) > limits.MaxKeyLength) ||
+		(limits.MaxValueLength > 0 && len(value) > limits.MaxValueLength) ||
+		(limits.MaxKeysPerMap > 0 && len(m) >= limits.MaxKeysPerMap) {
+		err = errMapTooLarge
+	}
+	return
+}
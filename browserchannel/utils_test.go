@@ -4,8 +4,14 @@
 package browserchannel
 
 import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -52,17 +58,35 @@ func TestParseIncomingMaps(t *testing.T) {
 		// Request body with two maps.
 		{"count=2&ofs=10&req0_key1=foo&req1_key2=bar",
 			10, []Map{{"key1": "foo"}, {"key2": "bar"}}, nil},
+		// Request body with a key containing underscores.
+		{"count=1&ofs=0&req0___data__=%7B%7D",
+			0, []Map{{"__data__": "{}"}}, nil},
 		// Request body with invalid request id (req2 should be req1).
 		{"count=2&ofs=10&req0_key=val&req3_key=val", 0, nil, errBadMap},
 		// Request body with an invalid offset value.
 		{"count=1&ofs=abc&req0_key=val", 0, nil, errBadMap},
 		// Request body with an invalid key id.
 		{"count=1&ofs=abc&reqABC_key=val", 0, nil, errBadMap},
+		// Request body with a map id equal to the count.
+		{"count=1&ofs=0&req1_key=val", 0, nil, errBadMap},
+		// Request body with a negative map id.
+		{"count=1&ofs=0&req-1_key=val", 0, nil, errBadMap},
+		// Request body with a negative count.
+		{"count=-1&ofs=0&req0_key=val", 0, nil, errBadMap},
+		// Request body with too many maps.
+		{"count=3&ofs=0&req0_key=val", 0, nil, errMapTooLarge},
+	}
+
+	limits := &MapLimits{
+		MaxMapsPerRequest: 2,
+		MaxKeysPerMap:     2,
+		MaxKeyLength:      10,
+		MaxValueLength:    16,
 	}
 
 	for i, c := range cases {
 		values, _ := url.ParseQuery(c.qs)
-		offset, maps, err := parseIncomingMaps(values)
+		offset, maps, bad, err := parseIncomingMaps(values, limits)
 		if err != c.err {
 			t.Errorf("case %d: expected error %v, got %s", i, c.err, err)
 		}
@@ -72,5 +96,232 @@ func TestParseIncomingMaps(t *testing.T) {
 		if !reflect.DeepEqual(maps, c.maps) {
 			t.Errorf("case %d: expected maps %#v, got %#v", i, c.maps, maps)
 		}
+		if len(bad) != 0 {
+			t.Errorf("case %d: unexpected bad maps %v", i, bad)
+		}
+	}
+}
+
+func TestParseBadMaps(t *testing.T) {
+	cases := []struct {
+		qs   string
+		maps []Map
+		bad  []BadMap
+	}{
+		// Map flagged as bad by the client.
+		{"count=2&ofs=5&req0_key=val&req1_type=_badmap",
+			[]Map{{"key": "val"}, nil},
+			[]BadMap{{6, url.Values{"req1_type": {"_badmap"}}, errBadMapType}}},
+		// Map with too many keys.
+		{"count=1&ofs=0&req0_a=1&req0_b=2&req0_c=3",
+			[]Map{nil},
+			[]BadMap{{0, url.Values{"req0_a": {"1"}, "req0_b": {"2"}, "req0_c": {"3"}}, errMapTooLarge}}},
+		// Map with a key that is too long.
+		{"count=2&ofs=0&req0_abcdefghijk=val&req1_key=val",
+			[]Map{nil, {"key": "val"}},
+			[]BadMap{{0, url.Values{"req0_abcdefghijk": {"val"}}, errMapTooLarge}}},
+		// Map with a value that is too long.
+		{"count=1&ofs=0&req0_key=" + strings.Repeat("v", 17),
+			[]Map{nil},
+			[]BadMap{{0, url.Values{"req0_key": {strings.Repeat("v", 17)}}, errMapTooLarge}}},
+	}
+
+	limits := &MapLimits{
+		MaxMapsPerRequest: 2,
+		MaxKeysPerMap:     2,
+		MaxKeyLength:      10,
+		MaxValueLength:    16,
+	}
+
+	for i, c := range cases {
+		values, _ := url.ParseQuery(c.qs)
+		_, maps, bad, err := parseIncomingMaps(values, limits)
+		if err != nil {
+			t.Errorf("case %d: unexpected error %s", i, err)
+		}
+		if !reflect.DeepEqual(maps, c.maps) {
+			t.Errorf("case %d: expected maps %#v, got %#v", i, c.maps, maps)
+		}
+		if len(bad) != len(c.bad) {
+			t.Errorf("case %d: expected %d bad maps, got %d", i, len(c.bad), len(bad))
+			continue
+		}
+		for j := range bad {
+			if !reflect.DeepEqual(*bad[j], c.bad[j]) {
+				t.Errorf("case %d: expected bad map %#v, got %#v", i, c.bad[j], *bad[j])
+			}
+		}
+	}
+}
+
+func TestParseBody(t *testing.T) {
+	cases := []struct {
+		body   string
+		values url.Values
+		err    error
+	}{
+		{"", url.Values{}, nil},
+		{"count=1&ofs=0&req0_key=a%20b", url.Values{
+			"count": {"1"}, "ofs": {"0"}, "req0_key": {"a b"}}, nil},
+		{"a=1&a=2&&b", url.Values{"a": {"1", "2"}, "b": {""}}, nil},
+		{"a=%zz", nil, url.EscapeError("%zz")},
+		// Body larger than the maximum body size.
+		{strings.Repeat("a="+strings.Repeat("b", 24)+"&", 10), nil, errBodyTooLarge},
+		// Pair longer than the maximum pair length.
+		{"req0_key=" + strings.Repeat("a", 64), nil, errMapTooLarge},
+		// Too many pairs.
+		{strings.Repeat("a=1&", 20), nil, errMapTooLarge},
+	}
+
+	limits := &MapLimits{
+		MaxMapsPerRequest: 1,
+		MaxKeysPerMap:     1,
+		MaxKeyLength:      4,
+		MaxValueLength:    4,
+		MaxBodySize:       256,
+	}
+
+	for i, c := range cases {
+		values, err := parseBody(strings.NewReader(c.body), limits)
+		if err != c.err {
+			t.Errorf("case %d: expected error %v, got %v", i, c.err, err)
+		}
+		if !reflect.DeepEqual(values, c.values) {
+			t.Errorf("case %d: expected values %#v, got %#v", i, c.values, values)
+		}
+	}
+}
+
+func FuzzParseBody(f *testing.F) {
+	f.Add("count=2&ofs=10&req0_key1=foo&req1_key2=bar")
+	f.Add("count=1&ofs=0&req0___data__=%7B%7D")
+	f.Add("count=1&ofs=0&req-1_key=val")
+	f.Add("count=100000&req99999_key=val")
+
+	limits := &MapLimits{
+		MaxMapsPerRequest: 16,
+		MaxKeysPerMap:     16,
+		MaxKeyLength:      64,
+		MaxValueLength:    256,
+		MaxBodySize:       4096,
+	}
+
+	f.Fuzz(func(t *testing.T, body string) {
+		values, err := parseBody(strings.NewReader(body), limits)
+		if err != nil {
+			return
+		}
+		_, maps, _, err := parseIncomingMaps(values, limits)
+		if err != nil {
+			return
+		}
+		if len(maps) > limits.MaxMapsPerRequest {
+			t.Fatalf("got %d maps", len(maps))
+		}
+		for _, m := range maps {
+			if len(m) > limits.MaxKeysPerMap {
+				t.Fatalf("got %d keys", len(m))
+			}
+		}
+	})
+}
+
+// A middleware response writer only implementing the FlushError method looked
+// up by http.ResponseController.
+type flushErrorResponseWriter struct {
+	rw http.ResponseWriter
+}
+
+func (w *flushErrorResponseWriter) Header() http.Header {
+	return w.rw.Header()
+}
+
+func (w *flushErrorResponseWriter) Write(data []byte) (int, error) {
+	return w.rw.Write(data)
+}
+
+func (w *flushErrorResponseWriter) WriteHeader(status int) {
+	w.rw.WriteHeader(status)
+}
+
+func (w *flushErrorResponseWriter) FlushError() error {
+	return http.NewResponseController(w.rw).Flush()
+}
+
+func TestCanFlush(t *testing.T) {
+	cases := []struct {
+		rw       http.ResponseWriter
+		expected bool
+	}{
+		{httptest.NewRecorder(), true},
+		{&flushErrorResponseWriter{httptest.NewRecorder()}, true},
+		{&unwrappableResponseWriter{httptest.NewRecorder()}, true},
+		{&unwrappableResponseWriter{&flushErrorResponseWriter{httptest.NewRecorder()}}, true},
+		{&opaqueResponseWriter{httptest.NewRecorder()}, false},
+		{&unwrappableResponseWriter{&opaqueResponseWriter{httptest.NewRecorder()}}, false},
+	}
+
+	for i, c := range cases {
+		if flushable := canFlush(c.rw); flushable != c.expected {
+			t.Errorf("case %d: expected %v, got %v", i, c.expected, flushable)
+		}
+		if supported := !errors.Is(flush(c.rw), http.ErrNotSupported); supported != c.expected {
+			t.Errorf("case %d: expected flush support %v, got %v", i, c.expected, supported)
+		}
+	}
+}
+
+func TestUtf16Length(t *testing.T) {
+	cases := []struct {
+		data   string
+		length int
+	}{
+		{"", 0},
+		{`["abc"]`, 7},
+		// Latin-1 and BMP characters are single code units.
+		{`["é"]`, 5},
+		{`["日本語"]`, 7},
+		// Astral plane characters are surrogate pairs.
+		{`["😀"]`, 6},
+		{`["a😀é日"]`, 9},
+	}
+
+	for _, c := range cases {
+		if n := utf16Length([]byte(c.data)); n != c.length {
+			t.Errorf("expected %d, got %d for %s", c.length, n, c.data)
+		}
+		prefixed := string(lengthPrefixed([]byte(c.data)))
+		if expected := strconv.Itoa(c.length) + "\n" + c.data; prefixed != expected {
+			t.Errorf("expected %q, got %q", expected, prefixed)
+		}
+	}
+}
+
+func TestEscapeNonAscii(t *testing.T) {
+	cases := []struct {
+		data    string
+		escaped string
+	}{
+		{`["abc"]`, `["abc"]`},
+		{`["é"]`, `["\u00e9"]`},
+		{`["日本"]`, `["\u65e5\u672c"]`},
+		{`["😀"]`, `["\ud83d\ude00"]`},
+		{`[1,["a😀é"]]`, `[1,["a\ud83d\ude00\u00e9"]]`},
+	}
+
+	for _, c := range cases {
+		escaped := escapeNonAscii([]byte(c.data))
+		if string(escaped) != c.escaped {
+			t.Errorf("expected %s, got %s", c.escaped, escaped)
+		}
+
+		var original, decoded interface{}
+		json.Unmarshal([]byte(c.data), &original)
+		if err := json.Unmarshal(escaped, &decoded); err != nil {
+			t.Errorf("invalid JSON %s: %v", escaped, err)
+		}
+		if !reflect.DeepEqual(original, decoded) {
+			t.Errorf("expected %v, got %v", original, decoded)
+		}
 	}
 }
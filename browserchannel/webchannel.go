@@ -0,0 +1,120 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// Header sent by goog.net.WebChannel clients to identify the protocol.
+	webChannelProtocolHeader = "X-Client-Protocol"
+	webChannelProtocol       = "webchannel"
+	// Header used to hand the session id to WebChannel clients configured
+	// with an httpSessionIdParam.
+	webChannelSessionIdHeader = "X-HTTP-Session-Id"
+	// URL parameter carrying headers that the client couldn't set without
+	// triggering a CORS preflight request.
+	webChannelHeadersParam = "$httpHeaders"
+	// URL parameter carrying a request body.
+	webChannelBodyParam = "$req"
+	// Map key under which WebChannel clients put JSON encoded messages.
+	webChannelDataKey = "__data__"
+)
+
+// Negotiates the protocol version with the client. BrowserChannel clients must
+// use the supported version whereas WebChannel clients may announce a newer
+// one, in which case the channel falls back to the supported version.
+func negotiateVersion(version int, webChannel bool) (negotiated int, ok bool) {
+	if version == SupportedProcolVersion ||
+		(webChannel && version > SupportedProcolVersion) {
+		return SupportedProcolVersion, true
+	}
+	return -1, false
+}
+
+// The headers of the $httpHeaders URL parameter that are applied to the
+// request. The other headers could be forged by the client to defeat the
+// origin check, the client keys or an authentication, see
+// RequestInfo.HeaderOverrides.
+var overridableHeaders = map[string]bool{
+	"Content-Type":                true,
+	"X-Client-Protocol":           true,
+	"X-Webchannel-Client-Profile": true,
+	"X-Webchannel-Content-Type":   true,
+}
+
+// Parses the headers encoded in the $httpHeaders URL parameter as
+// "key:value\r\n" lines. Returns nil when the parameter is absent.
+func parseHeadersOverride(req *http.Request) (header http.Header) {
+	overrides := req.URL.Query().Get(webChannelHeadersParam)
+	for _, line := range strings.Split(overrides, "\r\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 && len(strings.TrimSpace(parts[0])) > 0 {
+			if header == nil {
+				header = make(http.Header)
+			}
+			header.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		}
+	}
+	return
+}
+
+// Applies the overridable headers of the $httpHeaders URL parameter that the
+// request doesn't carry already.
+func applyHeadersOverride(req *http.Request) {
+	for name, values := range parseHeadersOverride(req) {
+		if overridableHeaders[name] && len(req.Header.Values(name)) == 0 {
+			req.Header[name] = values
+		}
+	}
+}
+
+// Merges the body encoded in the $req URL parameter into the body values.
+func mergeBodyParam(req *http.Request, values url.Values) (err error) {
+	body := req.URL.Query().Get(webChannelBodyParam)
+	if len(body) == 0 {
+		return
+	}
+
+	params, err := url.ParseQuery(body)
+	if err != nil {
+		return
+	}
+
+	for k, v := range params {
+		values[k] = append(values[k], v...)
+	}
+	return
+}
+
+// Decodes a map whose only entry is a JSON encoded message, as sent by
+// WebChannel clients. The members of a JSON object are copied in the map,
+// non string values being kept in their JSON representation. Other maps are
+// returned unmodified.
+func decodeWebChannelMap(m Map) Map {
+	data, ok := m[webChannelDataKey]
+	if !ok || len(m) != 1 {
+		return m
+	}
+
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &members); err != nil {
+		return m
+	}
+
+	decoded := make(Map, len(members))
+	for k, raw := range members {
+		var str string
+		if err := json.Unmarshal(raw, &str); err == nil {
+			decoded[k] = str
+		} else {
+			decoded[k] = string(raw)
+		}
+	}
+	return decoded
+}
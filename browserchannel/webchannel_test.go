@@ -0,0 +1,101 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	cases := []struct {
+		version    int
+		webChannel bool
+		negotiated int
+		ok         bool
+	}{
+		{8, false, 8, true},
+		{9, false, -1, false},
+		{7, false, -1, false},
+		{8, true, 8, true},
+		{9, true, 8, true},
+		{7, true, -1, false},
+	}
+
+	for _, c := range cases {
+		negotiated, ok := negotiateVersion(c.version, c.webChannel)
+		if negotiated != c.negotiated || ok != c.ok {
+			t.Errorf("expected (%d, %t), got (%d, %t) for %d (webchannel: %t)",
+				c.negotiated, c.ok, negotiated, ok, c.version, c.webChannel)
+		}
+	}
+}
+
+func TestApplyHeadersOverride(t *testing.T) {
+	overrides := "X-Client-Protocol:webchannel\r\nContent-Type: text/plain\r\n" +
+		"Origin: http://evil.com\r\nX-Forwarded-For: 1.2.3.4\r\n" +
+		"Authorization: Bearer forged\r\nX-WebChannel-Content-Type: application/json\r\n"
+	req, _ := http.NewRequest("POST",
+		"/channel/bind?$httpHeaders="+url.QueryEscape(overrides), nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	applyHeadersOverride(req)
+
+	expected := map[string]string{
+		"X-Client-Protocol":         "webchannel",
+		"X-Webchannel-Content-Type": "application/json",
+		// The headers of the request aren't overwritten.
+		"Content-Type": "application/x-www-form-urlencoded",
+		// The other headers aren't applied.
+		"Origin":          "",
+		"X-Forwarded-For": "",
+		"Authorization":   "",
+	}
+	for name, value := range expected {
+		if v := req.Header.Get(name); v != value {
+			t.Errorf("expected %s to be %q, got %q", name, value, v)
+		}
+	}
+
+	info := newRequestInfo(req, "")
+	if v := info.HeaderOverrides.Get("Authorization"); v != "Bearer forged" {
+		t.Errorf("expected the overrides to be exposed, got %v", info.HeaderOverrides)
+	}
+}
+
+func TestMergeBodyParam(t *testing.T) {
+	body := "count=1&ofs=0&req0_key=val"
+	req, _ := http.NewRequest("GET", "/channel/bind?$req="+url.QueryEscape(body), nil)
+
+	values := url.Values{}
+	if err := mergeBodyParam(req, values); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, _ := url.ParseQuery(body)
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v, got %v", expected, values)
+	}
+}
+
+func TestDecodeWebChannelMap(t *testing.T) {
+	cases := []struct {
+		m        Map
+		expected Map
+	}{
+		{Map{"key": "val"}, Map{"key": "val"}},
+		{Map{"__data__": `{"a":"b","c":1,"d":[1,2]}`},
+			Map{"a": "b", "c": "1", "d": "[1,2]"}},
+		{Map{"__data__": `[1,2]`}, Map{"__data__": `[1,2]`}},
+		{Map{"__data__": `{}`, "key": "val"}, Map{"__data__": `{}`, "key": "val"}},
+	}
+
+	for _, c := range cases {
+		if actual := decodeWebChannelMap(c.m); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("expected %v, got %v", c.expected, actual)
+		}
+	}
+}
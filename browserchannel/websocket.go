@@ -0,0 +1,466 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The GUID used to compute the Sec-WebSocket-Accept header value. See
+// http://tools.ietf.org/html/rfc6455#section-1.3.
+const webSocketGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Maximum size of a message, possibly fragmented, sent by a client.
+const maxWebSocketMessageSize = 1 << 20
+
+// WebSocket frame opcodes.
+const (
+	wsContinuationFrame = 0x0
+	wsTextFrame         = 0x1
+	wsBinaryFrame       = 0x2
+	wsCloseFrame        = 0x8
+	wsPingFrame         = 0x9
+	wsPongFrame         = 0xA
+)
+
+// WebSocket close status codes.
+const (
+	wsCloseNormal          = 1000
+	wsCloseGoingAway       = 1001
+	wsCloseProtocolError   = 1002
+	wsCloseUnsupportedData = 1003
+	wsCloseInvalidPayload  = 1007
+	wsCloseMessageTooBig   = 1009
+	wsCloseTryAgainLater   = 1013
+)
+
+var (
+	errBadHandshake        = errors.New("bad websocket handshake")
+	errWebSocketProtocol   = errors.New("websocket protocol error")
+	errWebSocketTooBig     = errors.New("websocket message too big")
+	errWebSocketUnexpected = errors.New("unexpected websocket frame")
+	errWebSocketClosed     = errors.New("websocket close frame sent")
+)
+
+// Computes the Sec-WebSocket-Accept header value for the given client key.
+func computeAcceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+webSocketGuid)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Checks whether the comma separated header contains the given token.
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A server-side WebSocket connection.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	// Serializes the writes made by the reader goroutine, which answers
+	// control frames, and the back channel writer.
+	lock      sync.Mutex
+	closeSent bool
+}
+
+// Validates the opening handshake described in section 4.2 of RFC 6455. On
+// failure, an error status is written to the response writer.
+func checkWebSocketHandshake(rw http.ResponseWriter, req *http.Request) (err error) {
+	decodedKey, _ := base64.StdEncoding.DecodeString(req.Header.Get("Sec-WebSocket-Key"))
+
+	if req.Method != "GET" ||
+		!headerHasToken(req.Header, "Connection", "upgrade") ||
+		!headerHasToken(req.Header, "Upgrade", "websocket") ||
+		len(decodedKey) != 16 {
+		rw.WriteHeader(400)
+		err = errBadHandshake
+		return
+	}
+
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		rw.Header().Set("Sec-WebSocket-Version", "13")
+		rw.WriteHeader(426)
+		err = errBadHandshake
+		return
+	}
+
+	if _, ok := rw.(http.Hijacker); !ok {
+		rw.WriteHeader(500)
+		err = errBadHandshake
+	}
+
+	return
+}
+
+// Performs the opening handshake and hijacks the underlying connection. On
+// failure, an error status is written to the response writer.
+func acceptWebSocket(rw http.ResponseWriter, req *http.Request) (ws *wsConn, err error) {
+	if err = checkWebSocketHandshake(rw, req); err != nil {
+		return
+	}
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	hijacker := rw.(http.Hijacker)
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	brw.WriteString("Upgrade: websocket\r\n")
+	brw.WriteString("Connection: Upgrade\r\n")
+	brw.WriteString("Sec-WebSocket-Accept: " + computeAcceptKey(key) + "\r\n")
+	brw.WriteString("\r\n")
+
+	if err = brw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	ws = &wsConn{conn: conn, r: brw.Reader, w: brw.Writer}
+	return
+}
+
+// Writes a single unmasked and unfragmented frame.
+// Writes a frame. Fails with errWebSocketClosed once the close frame was sent
+// since no frame may follow it.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) (err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closeSent {
+		return errWebSocketClosed
+	}
+	return c.writeFrameLocked(opcode, payload)
+}
+
+func (c *wsConn) writeFrameLocked(opcode byte, payload []byte) (err error) {
+	c.conn.SetWriteDeadline(time.Now().Add(backChannelWriteTimeout))
+	if err = writeFrameHeader(c.w, opcode, len(payload), nil); err != nil {
+		return
+	}
+	if _, err = c.w.Write(payload); err != nil {
+		return
+	}
+	return c.w.Flush()
+}
+
+// Writes a close frame unless one was already sent.
+func (c *wsConn) writeClose(status uint16) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, status)
+	return c.writeFrameLocked(wsCloseFrame, payload)
+}
+
+func (c *wsConn) close() error {
+	return c.conn.Close()
+}
+
+// Writes a frame header. The frame is masked when mask isn't nil.
+func writeFrameHeader(w io.Writer, opcode byte, length int, mask []byte) (err error) {
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | opcode
+
+	switch {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	if mask != nil {
+		header[1] |= 0x80
+		header = append(header, mask...)
+	}
+
+	_, err = w.Write(header)
+	return
+}
+
+// Reads a single frame and unmasks its payload. Client frames must be masked.
+func readFrame(r io.Reader, maxSize int) (fin bool, opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	if header[0]&0x70 != 0 || !masked {
+		err = errWebSocketProtocol
+		return
+	}
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err = io.ReadFull(r, ext); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err = io.ReadFull(r, ext); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	// Control frames can't be fragmented and carry at most 125 bytes.
+	if opcode >= wsCloseFrame && (!fin || length > 125) {
+		err = errWebSocketProtocol
+		return
+	}
+
+	if length > uint64(maxSize) {
+		err = errWebSocketTooBig
+		return
+	}
+
+	mask := make([]byte, 4)
+	if _, err = io.ReadFull(r, mask); err != nil {
+		return
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return
+}
+
+// Reads the next data message, reassembling fragmented messages and handling
+// the interleaved control frames. Returns io.EOF once the client has sent a
+// close frame.
+func (c *wsConn) readMessage() (opcode byte, message []byte, err error) {
+	for {
+		fin, op, payload, rerr := readFrame(c.r, maxWebSocketMessageSize-len(message))
+		if rerr != nil {
+			err = rerr
+			return
+		}
+
+		switch op {
+		case wsPingFrame:
+			// The pings received while waiting for the client to answer
+			// the close frame aren't answered.
+			if err = c.writeFrame(wsPongFrame, payload); err != nil && err != errWebSocketClosed {
+				return
+			}
+			err = nil
+			continue
+		case wsPongFrame:
+			continue
+		case wsCloseFrame:
+			c.writeClose(wsCloseNormal)
+			err = io.EOF
+			return
+		case wsContinuationFrame:
+			if message == nil {
+				err = errWebSocketUnexpected
+				return
+			}
+		case wsTextFrame, wsBinaryFrame:
+			if message != nil {
+				err = errWebSocketUnexpected
+				return
+			}
+			opcode = op
+			message = []byte{}
+		default:
+			err = errWebSocketProtocol
+			return
+		}
+
+		message = append(message, payload...)
+
+		if fin {
+			return
+		}
+	}
+}
+
+// Payload of the text frames sent by WebSocket clients. The maps are numbered
+// from the offset in the same way as the maps of a forward channel request
+// and the acknowledged array id has the same meaning as the AID parameter.
+type webSocketMessage struct {
+	Aid       *int  `json:"aid"`
+	Offset    int   `json:"ofs"`
+	Maps      []Map `json:"maps"`
+	Terminate bool  `json:"terminate"`
+}
+
+// The WebSocket back channel implementation. Unlike the XHR and HTML back
+// channels, it is also used as the forward channel: incoming text messages
+// are decoded into maps and delivered to the channel.
+type webSocketBackChannel struct {
+	backChannelBase
+	ws *wsConn
+}
+
+func newWebSocketBackChannel(sid SessionId, ws *wsConn, rid string) *webSocketBackChannel {
+	return &webSocketBackChannel{
+		backChannelBase: backChannelBase{
+			sid:      sid,
+			rid:      rid,
+			chunked:  true,
+			dataChan: make(chan []byte, dataChannelCapacity)},
+		ws: ws}
+}
+
+// The WebSocket back channel isn't subject to the size limit imposed on the
+// HTTP back channels since it doesn't accumulate data in the browser.
+func (b *webSocketBackChannel) isReusable() bool {
+	return b.err == nil
+}
+
+func (b *webSocketBackChannel) isPersistent() bool {
+	return true
+}
+
+// The request context isn't watched since the connection is hijacked. The
+// lost connections are detected by the reader goroutine and the failed
+// writes.
+func (b *webSocketBackChannel) wait(ctx context.Context, channel *Channel) {
+	for data := range b.dataChan {
+		log.Printf("%s[%s] websocket back channel send: %s\n", b.sid, b.rid, data)
+		if err := b.ws.writeFrame(wsTextFrame, data); err != nil {
+			log.Printf("%s[%s] websocket write failed: %s\n", b.sid, b.rid, err)
+			channel.failBackChannel(b)
+			break
+		}
+	}
+
+	// Drain the data channel in case the loop exited on a write error so
+	// the channel never blocks on a dead connection.
+	go func() {
+		for range b.dataChan {
+		}
+	}()
+
+	b.ws.writeClose(wsCloseNormal)
+	b.ws.close()
+
+	log.Printf("%s[%s] websocket wait done\n", b.sid, b.rid)
+}
+
+func (b *webSocketBackChannel) discard() {
+	log.Printf("%s[%s] websocket back channel close\n", b.sid, b.rid)
+	close(b.dataChan)
+}
+
+// Reads the client messages until the connection is closed, then detaches
+// the back channel from the channel so the reopen timeout starts. Clients
+// that don't respect the protocol get their channel terminated. The maps
+// exceeding the map limits are bad maps and the connection is closed if a
+// message carries too many maps.
+func (b *webSocketBackChannel) receive(channel *Channel, req *RequestInfo, limits *MapLimits) {
+	defer channel.removeBackChannel(b)
+
+	for {
+		opcode, data, err := b.ws.readMessage()
+		if err != nil {
+			switch err {
+			case io.EOF:
+			case errWebSocketTooBig:
+				b.ws.writeClose(wsCloseMessageTooBig)
+			case errWebSocketProtocol, errWebSocketUnexpected:
+				b.ws.writeClose(wsCloseProtocolError)
+				channel.terminate(CloseProtocolError)
+			default:
+				log.Printf("%s[%s] websocket read failed: %s\n", b.sid, b.rid, err)
+			}
+			return
+		}
+
+		if opcode != wsTextFrame {
+			b.ws.writeClose(wsCloseUnsupportedData)
+			channel.terminate(CloseProtocolError)
+			return
+		}
+
+		var message webSocketMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			b.ws.writeClose(wsCloseInvalidPayload)
+			channel.terminate(CloseProtocolError)
+			return
+		}
+
+		if message.Aid != nil {
+			channel.acknowledgeArrays(*message.Aid)
+		}
+
+		bad, err := checkIncomingMaps(message.Offset, message.Maps, limits)
+		if err != nil {
+			channel.log("%s", err)
+			b.ws.writeClose(wsCloseMessageTooBig)
+			return
+		}
+
+		err = channel.receiveMapsWait(context.Background(), req, message.Offset, message.Maps, bad)
+		if err == errPendingMapsFull {
+			channel.log("%s", err)
+			b.ws.writeClose(wsCloseTryAgainLater)
+			return
+		} else if err == errCapacityExceeded {
+			channel.log("%s", err)
+			b.ws.writeClose(wsCloseMessageTooBig)
+			return
+		} else if err != nil {
+			channel.log("%s", err)
+			b.ws.writeClose(wsCloseInvalidPayload)
+			return
+		}
+
+		if message.Terminate {
+			channel.terminate(CloseClientTerminated)
+			return
+		}
+	}
+}
@@ -0,0 +1,456 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testMask = []byte{0x12, 0x34, 0x56, 0x78}
+
+// Writes a masked frame as a client would.
+func writeClientFrame(w *bufio.Writer, fin bool, opcode byte, payload []byte) error {
+	var buf bytes.Buffer
+	writeFrameHeader(&buf, opcode, len(payload), testMask)
+	header := buf.Bytes()
+	if !fin {
+		header[0] &^= 0x80
+	}
+	w.Write(header)
+	for i, b := range payload {
+		w.WriteByte(b ^ testMask[i%4])
+	}
+	return w.Flush()
+}
+
+// Reads an unmasked frame as a client would.
+func readServerFrame(r *bufio.Reader) (opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if header[0], err = r.ReadByte(); err != nil {
+		return
+	}
+	if header[1], err = r.ReadByte(); err != nil {
+		return
+	}
+	opcode = header[0] & 0x0f
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		hi, _ := r.ReadByte()
+		lo, _ := r.ReadByte()
+		length = int(hi)<<8 | int(lo)
+	}
+	payload = make([]byte, length)
+	for i := range payload {
+		if payload[i], err = r.ReadByte(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func TestComputeAcceptKey(t *testing.T) {
+	// Example taken from section 1.3 of RFC 6455.
+	actual := computeAcceptKey("dGhlIHNhbXBsZSBub25jZQ==")
+	expected := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+	if actual != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	cases := []struct {
+		length int
+		err    error
+	}{
+		{0, nil},
+		{125, nil},
+		{126, nil},
+		{0xffff, nil},
+		{0x10000, nil},
+		{0x10001, errWebSocketTooBig},
+	}
+
+	for _, c := range cases {
+		var buf bytes.Buffer
+		payload := bytes.Repeat([]byte("a"), c.length)
+		writeClientFrame(bufio.NewWriter(&buf), true, wsTextFrame, payload)
+
+		fin, opcode, actual, err := readFrame(&buf, 0x10000)
+		if err != c.err {
+			t.Errorf("expected error %v, got %v for length %d", c.err, err, c.length)
+		}
+		if err != nil {
+			continue
+		}
+		if !fin || opcode != wsTextFrame || !bytes.Equal(actual, payload) {
+			t.Errorf("failed to read frame of length %d", c.length)
+		}
+	}
+}
+
+func TestReadFrameUnmasked(t *testing.T) {
+	var buf bytes.Buffer
+	writeFrameHeader(&buf, wsTextFrame, 2, nil)
+	buf.WriteString("{}")
+
+	if _, _, _, err := readFrame(&buf, 1024); err != errWebSocketProtocol {
+		t.Errorf("expected %v, got %v", errWebSocketProtocol, err)
+	}
+}
+
+func TestNoFrameAfterClose(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	ws := &wsConn{conn: server, r: bufio.NewReader(server), w: bufio.NewWriter(server)}
+
+	frames := make(chan byte, 3)
+	go func() {
+		r := bufio.NewReader(client)
+		for {
+			opcode, _, err := readServerFrame(r)
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- opcode
+		}
+	}()
+
+	if err := ws.writeFrame(wsTextFrame, []byte("[]")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.writeClose(wsCloseNormal); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.writeFrame(wsTextFrame, []byte("[]")); err != errWebSocketClosed {
+		t.Errorf("expected %v, got %v", errWebSocketClosed, err)
+	}
+	ws.close()
+
+	var opcodes []byte
+	for opcode := range frames {
+		opcodes = append(opcodes, opcode)
+	}
+	if !bytes.Equal(opcodes, []byte{wsTextFrame, wsCloseFrame}) {
+		t.Errorf("expected a text frame and a close frame, got %v", opcodes)
+	}
+}
+
+// Sends a WebSocket opening handshake to the given URL with the given headers.
+func upgradeWebSocket(t *testing.T, target string, header http.Header) (net.Conn, *bufio.ReadWriter, *http.Response) {
+	req, _ := http.NewRequest("GET", target, nil)
+	conn, err := net.Dial("tcp", req.URL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Write(conn)
+
+	brw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	resp, err := http.ReadResponse(brw.Reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, brw, resp
+}
+
+func dialWebSocket(t *testing.T, url string) (net.Conn, *bufio.ReadWriter) {
+	conn, brw, resp := upgradeWebSocket(t, url+"/channel/ws?VER=8", nil)
+	if resp.StatusCode != 101 {
+		t.Fatalf("expected status 101, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("bad accept key %s", resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	return conn, brw
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	handler := NewHandler(func(c *Channel) {})
+	handler.SetCrossDomainPrefix("example.com", []string{"bc0"})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	cases := []struct {
+		origin   string
+		expected int
+	}{
+		{"", 101},
+		{server.URL, 101},
+		{"http://example.com", 101},
+		{"https://bc0.example.com", 101},
+		{"http://evil.com", 403},
+		{"http://example.com.evil.com", 403},
+	}
+
+	for _, c := range cases {
+		header := http.Header{}
+		if len(c.origin) > 0 {
+			header.Set("Origin", c.origin)
+		}
+		conn, _, resp := upgradeWebSocket(t, server.URL+"/channel/ws?VER=8", header)
+		conn.Close()
+		if resp.StatusCode != c.expected {
+			t.Errorf("%q: expected status %d, got %d", c.origin, c.expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestWebSocketRefusedUpgrade(t *testing.T) {
+	created := make(chan bool, 2)
+	handler := NewHandler(func(c *Channel) { created <- true })
+	handler.SetSessionLimits(SessionLimits{MaxSessionsPerClient: 1})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	header := http.Header{"Sec-Websocket-Version": {"8"}}
+	conn, _, resp := upgradeWebSocket(t, server.URL+"/channel/ws?VER=8", header)
+	conn.Close()
+	if resp.StatusCode != 426 {
+		t.Fatalf("expected status 426, got %d", resp.StatusCode)
+	}
+
+	// The refused upgrade neither created a session nor kept its slot.
+	conn, _ = dialWebSocket(t, server.URL)
+	defer conn.Close()
+	select {
+	case <-created:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a session to be created")
+	}
+	if len(created) != 0 {
+		t.Error("expected a single session to be created")
+	}
+}
+
+func TestWebSocketChannel(t *testing.T) {
+	maps := make(chan Map, 10)
+	handler := NewHandler(func(c *Channel) {
+		for m := range c.Maps() {
+			maps <- m
+			c.SendArray(Array{m["text"]})
+		}
+		close(maps)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, brw := dialWebSocket(t, server.URL)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The first array sent on a new session is the channel configuration.
+	_, payload, err := readServerFrame(brw.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var arrays []Array
+	if err := json.Unmarshal(payload, &arrays); err != nil {
+		t.Fatal(err)
+	}
+	if len(arrays) != 1 || arrays[0][1].([]interface{})[0] != "c" {
+		t.Fatalf("expected channel configuration, got %s", payload)
+	}
+
+	// Send a map in two fragments.
+	message := []byte(`{"aid":1,"ofs":0,"maps":[{"text":"hello"}]}`)
+	writeClientFrame(brw.Writer, false, wsTextFrame, message[:10])
+	writeClientFrame(brw.Writer, true, wsContinuationFrame, message[10:])
+
+	select {
+	case m := <-maps:
+		if !reflect.DeepEqual(m, Map{"text": "hello"}) {
+			t.Fatalf("expected hello map, got %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for map")
+	}
+
+	_, payload, err = readServerFrame(brw.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != `[[2,["hello"]]]` {
+		t.Fatalf("expected echoed array, got %s", payload)
+	}
+
+	// A terminate message closes the session.
+	writeClientFrame(brw.Writer, true, wsTextFrame, []byte(`{"terminate":true}`))
+
+	select {
+	case _, ok := <-maps:
+		if ok {
+			t.Fatal("expected maps channel to be closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for termination")
+	}
+}
+
+func TestWebSocketIsntRecycled(t *testing.T) {
+	channels := make(chan *Channel, 1)
+	handler := NewHandler(func(c *Channel) { channels <- c })
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, brw := dialWebSocket(t, server.URL)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Skip the channel configuration.
+	if _, _, err := readServerFrame(brw.Reader); err != nil {
+		t.Fatal(err)
+	}
+	c := <-channels
+	defer c.Close()
+
+	// More unacknowledged arrays than the XHR back channels allow.
+	for i := 0; i < 2*maxOutgoingArrays; i++ {
+		c.SendArray(Array{i})
+		opcode, payload, err := readServerFrame(brw.Reader)
+		if err != nil {
+			t.Fatalf("array %d: %s", i, err)
+		}
+		if opcode != wsTextFrame {
+			t.Fatalf("array %d: unexpected frame %d %v", i, opcode, payload)
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.backChannel == nil {
+		t.Error("expected the WebSocket back channel to be kept")
+	}
+	if c.backChannelExpiration != nil {
+		t.Error("expected the WebSocket back channel not to expire")
+	}
+}
+
+func TestWebSocketMapLimits(t *testing.T) {
+	maps := make(chan Map, 10)
+	bad := make(chan *BadMap, 10)
+	handler := NewHandler(func(c *Channel) {
+		for m := range c.Maps() {
+			maps <- m
+		}
+	})
+	handler.SetMapLimits(MapLimits{MaxMapsPerRequest: 3, MaxKeysPerMap: 2, MaxValueLength: 5})
+	handler.SetBadMapHandler(func(c *Channel, b *BadMap) { bad <- b })
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, brw := dialWebSocket(t, server.URL)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Skip the channel configuration.
+	if _, _, err := readServerFrame(brw.Reader); err != nil {
+		t.Fatal(err)
+	}
+
+	message := []byte(`{"ofs":0,"maps":[{"a":"123456"},{"a":"1","b":"2","c":"3"},{"a":"ok"}]}`)
+	writeClientFrame(brw.Writer, true, wsTextFrame, message)
+
+	select {
+	case m := <-maps:
+		if !reflect.DeepEqual(m, Map{"a": "ok"}) {
+			t.Fatalf("expected ok map, got %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for map")
+	}
+	for _, id := range []int{0, 1} {
+		select {
+		case b := <-bad:
+			if b.Id != id || b.Err != errMapTooLarge {
+				t.Errorf("expected bad map %d, got %d: %v", id, b.Id, b.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for bad map")
+		}
+	}
+
+	// A message carrying too many maps closes the connection.
+	message = []byte(`{"ofs":3,"maps":[{},{},{},{}]}`)
+	writeClientFrame(brw.Writer, true, wsTextFrame, message)
+
+	opcode, payload, err := readServerFrame(brw.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != wsCloseFrame || binary.BigEndian.Uint16(payload) != wsCloseMessageTooBig {
+		t.Errorf("expected close frame %d, got %d %v", wsCloseMessageTooBig, opcode, payload)
+	}
+}
+
+func TestWebSocketVersionRouter(t *testing.T) {
+	routed := make(chan string, 1)
+	router := NewVersionRouter()
+	router.Handle("2.0.0", func(c *Channel) { routed <- c.Version })
+
+	handler := NewHandler(func(c *Channel) {})
+	handler.SetVersionRouter(router)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, _, resp := upgradeWebSocket(t, server.URL+"/channel/ws?VER=8&CVER=2.0.0", nil)
+	conn.Close()
+	if resp.StatusCode != 101 {
+		t.Fatalf("expected status 101, got %d", resp.StatusCode)
+	}
+	select {
+	case version := <-routed:
+		if version != "2.0.0" {
+			t.Errorf("expected client version 2.0.0, got %s", version)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the channel to be routed")
+	}
+
+	// The unsupported versions receive the 'c' array and the stop array.
+	conn, brw, resp := upgradeWebSocket(t, server.URL+"/channel/ws?VER=8&CVER=1.0.0", nil)
+	defer conn.Close()
+	if resp.StatusCode != 101 {
+		t.Fatalf("expected status 101, got %d", resp.StatusCode)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var arrays []Array
+	for len(arrays) < 2 {
+		_, payload, err := readServerFrame(brw.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var received []Array
+		if err := json.Unmarshal(payload, &received); err != nil {
+			t.Fatalf("expected arrays, got %s", payload)
+		}
+		arrays = append(arrays, received...)
+	}
+	if arrays[0][1].([]interface{})[0] != "c" {
+		t.Errorf("expected the 'c' array, got %v", arrays[0])
+	}
+	stop := arrays[1][1].([]interface{})
+	if stop[0] != "stop" || stop[1] != float64(CloseUnsupportedVersion) {
+		t.Errorf("expected the stop array, got %v", arrays[1])
+	}
+}
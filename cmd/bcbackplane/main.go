@@ -0,0 +1,28 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+// Command bcbackplane runs a TCP backplane server relaying the messages
+// published by the browser channel handlers of a cluster. See
+// browserchannel.DialBackplane.
+package main
+
+import (
+	"flag"
+	bc "github.com/MathieuTurcotte/go-browserchannel/browserchannel"
+	"log"
+	"net"
+)
+
+var addr = flag.String("addr", "localhost:7070", "the address to listen on")
+
+func main() {
+	flag.Parse()
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal("Listen: ", err)
+	}
+
+	log.Printf("backplane listening on %s\n", l.Addr())
+	log.Fatal(bc.ServeBackplane(l))
+}
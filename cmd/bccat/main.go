@@ -0,0 +1,145 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+// Command bccat connects to a browser channel endpoint, sends the lines read
+// on stdin as maps and prints the arrays received along with their ids. The
+// lines are either query strings, e.g. a=1&b=2, or JSON objects, e.g.
+// {"a":"1","b":2}, whose non-string values are sent as JSON. The session is
+// terminated on interrupt, or when stdin is closed once the last maps were
+// acknowledged and given some time to be answered, see the linger flag.
+//
+//	bccat http://localhost:8080/channel
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/MathieuTurcotte/go-browserchannel/browserchannel/client"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+var backChannel = flag.String("back_channel", client.XmlHttp, "the back channel type, xmlhttp or html")
+var noStreaming = flag.Bool("no_streaming", false, "whether the back channels aren't streamed (CI=1)")
+var hostPrefix = flag.Bool("host_prefix", false, "whether the host prefixes are used")
+var clientVersion = flag.String("client_version", "", "the client version sent as CVER")
+var linger = flag.Duration("linger", time.Second, "how long the arrays are awaited once stdin is closed")
+var verbose = flag.Bool("v", false, "whether the session details are logged")
+
+var errEmptyMap = errors.New("empty map")
+
+// Parses a query string or a JSON object into a map.
+func parseLine(line string) (m map[string]string, err error) {
+	m = make(map[string]string)
+	if strings.HasPrefix(line, "{") {
+		var object map[string]json.RawMessage
+		if err = json.Unmarshal([]byte(line), &object); err != nil {
+			return
+		}
+		for key, raw := range object {
+			var s string
+			if json.Unmarshal(raw, &s) == nil {
+				m[key] = s
+			} else {
+				m[key] = string(raw)
+			}
+		}
+	} else {
+		var values url.Values
+		if values, err = url.ParseQuery(line); err != nil {
+			return
+		}
+		for key := range values {
+			m[key] = values.Get(key)
+		}
+	}
+	if len(m) == 0 {
+		err = errEmptyMap
+	}
+	return
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] endpoint\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	log.SetOutput(os.Stderr)
+
+	c, err := client.Dial(flag.Arg(0), &client.Options{
+		ClientVersion: *clientVersion,
+		BackChannel:   *backChannel,
+		NoStreaming:   *noStreaming,
+		UseHostPrefix: *hostPrefix,
+	})
+	if err != nil {
+		log.Fatal("Dial: ", err)
+	}
+	if *verbose {
+		log.Printf("session %s, host prefix %q, chunked %v\n", c.Sid(), c.HostPrefix(), c.Chunked())
+	}
+
+	// Closes the session on interrupt or once stdin is exhausted.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		c.Close()
+	}()
+
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) == 0 {
+				continue
+			}
+			m, err := parseLine(line)
+			if err != nil {
+				log.Printf("%q: %s\n", line, err)
+				continue
+			}
+			if err = c.SendMap(m); err != nil {
+				break
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Printf("stdin: %s\n", err)
+		}
+
+		// Gives the server a chance to answer the last maps.
+		ctx, cancel := context.WithTimeout(context.Background(), *linger)
+		defer cancel()
+		if c.Flush(ctx) == nil {
+			<-ctx.Done()
+		}
+		c.Close()
+	}()
+
+	for a := range c.Arrays() {
+		fmt.Printf("%d %s\n", a.Id, a.Data)
+	}
+
+	if err := c.Err(); err != client.ErrClosed {
+		log.Fatal(err)
+	}
+	if *verbose {
+		stats := c.Stats()
+		log.Printf("%d arrays, %d back channels, %d forward channels, %d retries\n",
+			stats.Arrays, stats.BackChannels, stats.ForwardRequests, stats.Retries)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+// Command bcfault runs a reverse proxy in front of a browser channel server,
+// injecting faults in the test and bind requests according to its rules. See
+// faultproxy.ParseRule for the syntax of the rules, e.g.
+//
+//	bcfault -target http://localhost:8080 -rule "back drop chunk=1 times=2" \
+//		-rule "forward fail status=503 forward times=1"
+package main
+
+import (
+	"flag"
+	"github.com/MathieuTurcotte/go-browserchannel/browserchannel/faultproxy"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// The rules given on the command line.
+type rules []faultproxy.Rule
+
+func (r *rules) String() string {
+	s := make([]string, len(*r))
+	for i, rule := range *r {
+		s[i] = rule.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+func (r *rules) Set(value string) error {
+	rule, err := faultproxy.ParseRule(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+var addr = flag.String("addr", "localhost:8081", "the address to listen on")
+var target = flag.String("target", "http://localhost:8080", "the browser channel server")
+var faults rules
+
+func main() {
+	flag.Var(&faults, "rule", "a fault injection rule, may be repeated")
+	flag.Parse()
+
+	u, err := url.Parse(*target)
+	if err != nil {
+		log.Fatal("Parse: ", err)
+	}
+
+	// The responses are flushed as they're received so the chunks of the
+	// back channels are preserved.
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.FlushInterval = -1
+
+	for _, rule := range faults {
+		log.Printf("rule: %s\n", rule)
+	}
+	log.Printf("proxying %s on %s\n", u, *addr)
+	err = http.ListenAndServe(*addr, faultproxy.New(proxy, faults...))
+	if err != nil {
+		log.Fatal("ListenAndServe: ", err)
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+// Command bcload simulates browser channel clients to measure how many
+// sessions a server sustains. Each session goes through the test channel
+// handshake, keeps a back channel open and sends maps at a fixed rate. The
+// maps carry a token, e.g. bcload:12:345, and their round trip is measured
+// when an array containing their token is received, so the server has to echo
+// or broadcast them, as the example server does.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/MathieuTurcotte/go-browserchannel/browserchannel/client"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var endpoint = flag.String("endpoint", "http://localhost:8080/channel", "the browser channel endpoint")
+var sessions = flag.Int("sessions", 100, "the number of simulated sessions")
+var rate = flag.Float64("rate", 1, "the maps sent per second by each session")
+var duration = flag.Duration("duration", 30*time.Second, "how long the maps are sent")
+var ramp = flag.Duration("ramp", 10*time.Millisecond, "the delay between the start of two sessions")
+var payload = flag.Int("payload", 0, "the number of padding bytes added to the maps")
+var backChannel = flag.String("back_channel", client.XmlHttp, "the back channel type, xmlhttp or html")
+var noStreaming = flag.Bool("no_streaming", false, "whether the back channels aren't streamed (CI=1)")
+var hostPrefix = flag.Bool("host_prefix", false, "whether the host prefixes are used")
+var interval = flag.Duration("interval", 5*time.Second, "the delay between two progress reports")
+
+// Matches the tokens of the maps sent by the sessions.
+var tokenRegexp = regexp.MustCompile(`bcload:(\d+):(\d+)`)
+
+// The time given to the last maps to come back once the sending stops.
+const drainDelay = 2 * time.Second
+
+// The measures of all the sessions.
+type results struct {
+	sync.Mutex
+	connected  int
+	failed     int
+	connects   []time.Duration
+	roundTrips []time.Duration
+	sent       int
+	received   int
+	errors     map[string]int
+	stats      client.Stats
+}
+
+func (r *results) addError(err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.errors[err.Error()]++
+}
+
+func (r *results) addStats(stats client.Stats) {
+	r.Lock()
+	defer r.Unlock()
+	r.stats.Arrays += stats.Arrays
+	r.stats.Duplicates += stats.Duplicates
+	r.stats.BackChannels += stats.BackChannels
+	r.stats.ForwardRequests += stats.ForwardRequests
+	r.stats.Retries += stats.Retries
+}
+
+// Returns the given percentile of sorted durations.
+func percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	i := int(p / 100 * float64(len(durations)-1))
+	return durations[i]
+}
+
+func formatLatencies(durations []time.Duration) string {
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return fmt.Sprintf("n=%d p50=%v p90=%v p99=%v max=%v", len(sorted),
+		percentile(sorted, 50), percentile(sorted, 90), percentile(sorted, 99),
+		percentile(sorted, 100))
+}
+
+func (r *results) report(final bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	log.Printf("sessions: %d connected, %d failed\n", r.connected, r.failed)
+	log.Printf("connect: %s\n", formatLatencies(r.connects))
+	log.Printf("round trip: %s\n", formatLatencies(r.roundTrips))
+	log.Printf("maps: %d sent, %d received\n", r.sent, r.received)
+	if !final {
+		return
+	}
+
+	resends := 0.0
+	if total := r.stats.Arrays + r.stats.Duplicates; total > 0 {
+		resends = float64(r.stats.Duplicates) / float64(total) * 100
+	}
+	log.Printf("arrays: %d received, %d resent by the server (%.2f%%)\n",
+		r.stats.Arrays, r.stats.Duplicates, resends)
+	log.Printf("requests: %d back channels, %d forward channels, %d retries\n",
+		r.stats.BackChannels, r.stats.ForwardRequests, r.stats.Retries)
+
+	messages := make([]string, 0, len(r.errors))
+	for message := range r.errors {
+		messages = append(messages, message)
+	}
+	sort.Strings(messages)
+	for _, message := range messages {
+		log.Printf("error: %s (%d)\n", message, r.errors[message])
+	}
+}
+
+// Runs a session until stop is closed.
+func runSession(id int, opts *client.Options, r *results, stop <-chan struct{}) {
+	start := time.Now()
+	c, err := client.Dial(*endpoint, opts)
+	if err != nil {
+		r.Lock()
+		r.failed++
+		r.Unlock()
+		r.addError(err)
+		return
+	}
+
+	r.Lock()
+	r.connected++
+	r.connects = append(r.connects, time.Since(start))
+	r.Unlock()
+
+	var lock sync.Mutex
+	pending := make(map[string]time.Time)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for a := range c.Arrays() {
+			now := time.Now()
+			for _, match := range tokenRegexp.FindAllStringSubmatch(string(a.Data), -1) {
+				if match[1] != strconv.Itoa(id) {
+					continue
+				}
+				lock.Lock()
+				sent, ok := pending[match[2]]
+				delete(pending, match[2])
+				lock.Unlock()
+				if ok {
+					r.Lock()
+					r.received++
+					r.roundTrips = append(r.roundTrips, now.Sub(sent))
+					r.Unlock()
+				}
+			}
+		}
+	}()
+
+	padding := strings.Repeat("x", *payload)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	defer ticker.Stop()
+
+	for seq := 0; ; seq++ {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			time.Sleep(drainDelay)
+			c.Close()
+			<-done
+			r.addStats(c.Stats())
+			return
+		case <-done:
+			r.addError(c.Err())
+			r.addStats(c.Stats())
+			return
+		}
+
+		key := strconv.Itoa(seq)
+		lock.Lock()
+		pending[key] = time.Now()
+		lock.Unlock()
+
+		text := fmt.Sprintf("bcload:%d:%d %s", id, seq, padding)
+		if err := c.SendMap(map[string]string{"text": text}); err == nil {
+			r.Lock()
+			r.sent++
+			r.Unlock()
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	if *rate <= 0 {
+		log.Fatal("rate must be positive")
+	}
+
+	// Each session holds a back channel and a forward channel.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 2 * *sessions
+	opts := &client.Options{
+		HTTPClient:    &http.Client{Transport: transport},
+		BackChannel:   *backChannel,
+		NoStreaming:   *noStreaming,
+		UseHostPrefix: *hostPrefix,
+	}
+
+	r := &results{errors: make(map[string]int)}
+	stop := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	var wg sync.WaitGroup
+	launched := make(chan struct{})
+	go func() {
+		defer close(launched)
+		for i := 0; i < *sessions; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				runSession(id, opts, r, stop)
+			}(i)
+			time.Sleep(*ramp)
+		}
+	}()
+
+	ticker := time.NewTicker(*interval)
+	deadline := time.After(*duration)
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			r.report(false)
+		case <-deadline:
+			break loop
+		case <-interrupt:
+			break loop
+		}
+	}
+	ticker.Stop()
+
+	log.Println("stopping the sessions")
+	close(stop)
+	<-launched
+	wg.Wait()
+	r.report(true)
+}
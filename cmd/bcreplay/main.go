@@ -0,0 +1,91 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+// Command bcreplay replays a recording made with browserchannel.Recorder and
+// reports the responses that don't match the recorded ones. The recording is
+// replayed against the server given by -target or, by default, against an
+// in-process handler echoing the maps it receives, which is enough to
+// reproduce most protocol level bugs. Exits with status 1 on mismatches.
+package main
+
+import (
+	"flag"
+	"fmt"
+	bc "github.com/MathieuTurcotte/go-browserchannel/browserchannel"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+)
+
+var recording = flag.String("recording", "", "the recording to replay, read from stdin when empty")
+var target = flag.String("target", "", "the base URL of the server to replay against, e.g. http://localhost:8080")
+var speed = flag.Float64("speed", 1, "the speed of the replay relative to the recording")
+var sid = flag.String("sid", "", "only replay the requests of the given session")
+var grace = flag.Duration("grace", bc.DefaultReplayGrace, "the delay given to the responses after their recorded duration")
+
+// Sends back the maps received on the channel.
+func echo(channel *bc.Channel) {
+	for m := range channel.Maps() {
+		channel.SendArray(bc.Array{m})
+	}
+}
+
+// Replays the recording and prints the mismatches. Returns an error when the
+// recording can't be replayed or when some responses don't match.
+func run() error {
+	var r io.Reader = os.Stdin
+	if len(*recording) > 0 {
+		file, err := os.Open(*recording)
+		if err != nil {
+			return fmt.Errorf("open: %w", err)
+		}
+		defer file.Close()
+		r = file
+	}
+
+	records, err := bc.ReadRecording(r)
+	if err != nil {
+		return fmt.Errorf("read recording: %w", err)
+	}
+
+	if len(*sid) > 0 {
+		var filtered []*bc.Record
+		for _, record := range records {
+			if record.Sid == *sid {
+				filtered = append(filtered, record)
+			}
+		}
+		records = filtered
+	}
+
+	baseURL := *target
+	if len(baseURL) == 0 {
+		server := httptest.NewServer(bc.NewHandler(echo))
+		defer server.Close()
+		baseURL = server.URL
+	}
+
+	mismatches, err := bc.Replay(records, baseURL, bc.ReplayOptions{Speed: *speed, Grace: *grace})
+	if err != nil {
+		return fmt.Errorf("replay: %w", err)
+	}
+
+	for _, m := range mismatches {
+		fmt.Println(m)
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%d mismatches", len(mismatches))
+	}
+	return nil
+}
+
+// The deferred calls of run complete before the process exits.
+func main() {
+	flag.Parse()
+
+	if err := run(); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
@@ -9,43 +9,32 @@ import (
 	bc "github.com/MathieuTurcotte/go-browserchannel/browserchannel"
 	"log"
 	"net/http"
-	"sync"
 )
 
 var publicDir = flag.String("public_directory", "", "path to public directory")
 var closureDir = flag.String("closure_directory", "", "path to closure directory")
 var port = flag.String("port", "8080", "the port to listen on")
 var hostname = flag.String("hostname", "hpenvy.local", "the server hostname")
+var backplane = flag.String("backplane", "", "the address of a backplane server, see cmd/bcbackplane")
 
-var channels = struct {
-	sync.RWMutex
-	m map[bc.SessionId]*bc.Channel
-}{m: make(map[bc.SessionId]*bc.Channel)}
+// The topic the maps received from the clients are broadcast to.
+const broadcastTopic = "broadcast"
 
-func broadcast(m bc.Map) {
-	channels.RLock()
-	defer channels.RUnlock()
+var handler *bc.Handler
 
-	for _, c := range channels.m {
-		c.SendArray(bc.Array{fmt.Sprintf("%#v", m)})
-	}
+func broadcast(m bc.Map) {
+	handler.Publish(broadcastTopic, bc.Array{fmt.Sprintf("%#v", m)})
 }
 
 func handleChannel(channel *bc.Channel) {
 	log.Printf("Handlechannel (%q)\n", channel.Sid)
 
-	channels.Lock()
-	channels.m[channel.Sid] = channel
-	channels.Unlock()
+	channel.Subscribe(broadcastTopic)
 
 	for {
 		m, ok := <-channel.Maps()
 		if !ok {
-			log.Printf("%s: returned with no data, closing\n", channel.Sid)
-
-			channels.Lock()
-			delete(channels.m, channel.Sid)
-			channels.Unlock()
+			log.Printf("%s: %v\n", channel.Sid, channel.Err())
 			break
 		}
 
@@ -57,9 +46,18 @@ func handleChannel(channel *bc.Channel) {
 func main() {
 	flag.Parse()
 
-	handler := bc.NewHandler(handleChannel)
+	handler = bc.NewHandler(handleChannel)
+	handler.SetPrefix("/channel")
 	handler.SetCrossDomainPrefix(*hostname+":"+*port, []string{"bc0", "bc1"})
 
+	if len(*backplane) > 0 {
+		b, err := bc.DialBackplane(*backplane)
+		if err != nil {
+			log.Fatal("DialBackplane: ", err)
+		}
+		handler.SetBackplane(b)
+	}
+
 	http.Handle("/channel/", handler)
 	http.Handle("/closure/", http.StripPrefix("/closure/", http.FileServer(http.Dir(*closureDir))))
 	http.Handle("/", http.FileServer(http.Dir(*publicDir)))
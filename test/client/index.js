@@ -16,7 +16,7 @@ goog.require('tests.Handler2');
 /**
  * Test driver entry point. Selects a test handler based on the "test" query
  * parameter and connects the browser channel configured with the handler to
- * the server.
+ * the server. The client version identifies the test case to the server.
  */
 tests.start = function() {
     goog.debug.Console.autoInstall();
@@ -39,7 +39,7 @@ tests.start = function() {
         return;
     }
 
-    var clientVersion = 'cv1';
+    var clientVersion = 'test' + id;
     var channel = new goog.net.BrowserChannel(clientVersion);
     channel.setChannelDebug(new goog.net.ChannelDebug());
     channel.setSupportsCrossDomainXhrs(true);
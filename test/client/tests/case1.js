@@ -47,7 +47,6 @@ tests.Handler1.prototype.logger_ =
 /** @override */
 tests.Handler1.prototype.channelOpened = function(channel) {
     this.logger_.info('channelOpened');
-    channel.sendMap({id: '1'});
     this.timer_.start();
 };
 
@@ -66,7 +66,6 @@ tests.Handler2.NUM_MAP_TO_SEND = 10;
 
 /** @override */
 tests.Handler2.prototype.channelOpened = function(channel) {
-    channel.sendMap({id: '2'});
     this.sendNextArray_(channel);
 };
 
@@ -47,32 +47,6 @@ func handleTest1(channel *bc.Channel) {
 	}
 }
 
-func handleChannel(channel *bc.Channel) {
-	log.Printf("handleChannel: %q\n", channel.Sid)
-
-	testHandlers := map[string]bc.ChannelHandler{
-		"1": handleTest1,
-		"2": handleTest2,
-	}
-
-	select {
-	case m, ok := <-channel.Maps():
-		if ok {
-			id := m["id"]
-			if handler, ok := testHandlers[id]; ok {
-				handler(channel)
-			} else {
-				log.Printf("%s: no test handler for %s\n", channel.Sid, id)
-			}
-		} else {
-			log.Printf("%s: returned with no data, closing\n", channel.Sid)
-		}
-	case <-time.After(10 * time.Second):
-		log.Printf("%s: timed out before selecting test case\n", channel.Sid)
-		channel.Close()
-	}
-}
-
 type statusLoggingResponseWriter struct {
 	status int
 	http.ResponseWriter
@@ -99,7 +73,12 @@ func main() {
 	log.Printf("closure dir: %s", *closureDir)
 	log.Printf("public dir: %s", *publicDir)
 
-	handler := bc.NewHandler(handleChannel)
+	// The test cases are identified by the client version.
+	router := bc.NewVersionRouter()
+	router.Handle("test1", handleTest1)
+	router.Handle("test2", handleTest2)
+
+	handler := bc.NewHandler(router.ServeChannel)
 	handler.SetCrossDomainPrefix(*hostname+":"+*port, []string{"bc0", "bc1", "bc2"})
 
 	http.Handle("/channel/", handler)